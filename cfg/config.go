@@ -1,47 +1,484 @@
 package cfg
 
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 type Config struct {
-	Version  string             `yaml:"version"`
-	Features map[string]Feature `yaml:"features"`
+	// Version is the schema version the config is written in, see
+	// SchemaVersion.
+	Version string `yaml:"version,omitempty"`
+	// Environment makes the file an overlay for the named environment, which
+	// is only loaded for that environment and changes the features and
+	// segments in the other files, see ApplyOverlay.
+	Environment string             `yaml:"environment,omitempty"`
+	Features    map[string]Feature `yaml:"features,omitempty"`
+
+	// Segments are named conditions that rules and conditions can refer to
+	// with `segment`, so the same list of users doesn't have to be copied
+	// into every feature.
+	Segments map[string]Condition `yaml:"segments,omitempty"`
+
+	// Revision is a hash of the files the config was loaded from.
+	Revision string `yaml:"-"`
+	// Positions are where everything in the config was loaded from.
+	Positions Positions `yaml:"-"`
+	// Warnings are problems with the config that don't stop it loading,
+	// such as values that mean something different to what they used to.
+	Warnings []error `yaml:"-"`
 }
 
+// Bucketing strategies for weighted rules.
+const (
+	// BucketingSalted mixes the feature's salt into the hash, so each feature
+	// selects an independent set of users. This is the default in version 2
+	// configs.
+	BucketingSalted = "salted"
+	// BucketingLegacy hashes only the field values, so every feature with the
+	// same fields and weight selects the same users. This is the default in
+	// version 1 configs, so upgrading doesn't reshuffle existing rollouts.
+	BucketingLegacy = "legacy"
+)
+
+// Rule modes, which decide how a rule's weight combines with its values and
+// conditions.
+const (
+	// RuleModeOr enables users who match the rule's values or conditions,
+	// and separately a percentage of all users. This is the default in
+	// version 1 configs.
+	RuleModeOr = "or"
+	// RuleModeAnd applies the rule's weight only to the users who match its
+	// values and conditions, e.g. 50% of enterprise customers. This is the
+	// default in version 2 configs.
+	RuleModeAnd = "and"
+)
+
 type Feature struct {
-	Rules Rules `yaml:"rules"`
+	// Window limits when the feature can be enabled at all.
+	Window `yaml:",inline"`
+
+	// Salt is mixed into the hash for weighted rules. Defaults to the feature
+	// name.
+	Salt string `yaml:"salt,omitempty"`
+	// Bucketing is one of the Bucketing constants. It's only empty for
+	// features from version 1 files, which use legacy bucketing.
+	Bucketing string `yaml:"bucketing,omitempty"`
+
+	Description string `yaml:"description,omitempty"`
+	// Owner is the person or team responsible for the feature.
+	Owner string `yaml:"owner,omitempty"`
+	// Tags group features, so clients can ask for every feature with a tag.
+	Tags      []string   `yaml:"tags,omitempty"`
+	CreatedAt *time.Time `yaml:"created_at,omitempty"`
+	// ExpiresAt is when the feature should have been removed from the
+	// config by. Expired features still work, but loading the config warns
+	// about them.
+	ExpiresAt *time.Time `yaml:"expires_at,omitempty"`
+
+	// Requires lists features that have to be enabled for the same vars
+	// before this one can be.
+	Requires []Prerequisite `yaml:"requires,omitempty"`
+
+	Variants Variants `yaml:"variants,omitempty"`
+	Rules    Rules    `yaml:"rules,omitempty"`
+
+	// Merge allows the feature to be defined in more than one file, in
+	// which case the definitions are merged. Every definition has to set
+	// it, so one team can't change another's rollout by accident.
+	Merge bool `yaml:"merge,omitempty"`
+	// Overlay is how a feature in an environment's overlay file changes the
+	// feature in the base config, one of the Overlay constants. Only overlay
+	// files can set it.
+	Overlay string `yaml:"overlay,omitempty"`
+
+	// Sources are the files the feature was loaded from, relative to the
+	// config directory.
+	Sources []string `yaml:"-"`
+}
+
+// Expired returns the names of the features that have expired by now, sorted.
+func (c Config) Expired(now time.Time) []string {
+	var expired []string
+	for _, name := range c.featureNames() {
+		if f := c.Features[name]; f.ExpiresAt != nil && !now.Before(*f.ExpiresAt) {
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+func (f Feature) HasTag(tag string) bool {
+	for _, t := range f.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Prerequisite is a feature that has to be enabled, optionally with a
+// specific variant. In YAML it's either the feature name, or a map with the
+// feature and variant.
+type Prerequisite struct {
+	Feature string `yaml:"feature,omitempty"`
+	Variant string `yaml:"variant,omitempty"`
+}
+
+func (p *Prerequisite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.Feature); err == nil {
+		return nil
+	}
+	// avoid recursing into this method
+	type prerequisite Prerequisite
+	return unmarshal((*prerequisite)(p))
+}
+
+// Variants splits the users an enabled feature applies to between named
+// variants, e.g. for A/B/n tests.
+type Variants struct {
+	// Field/Fields are hashed to pick a variant. If neither is set, the
+	// fields of the enable rule that matched are used.
+	Field  string   `yaml:"field,omitempty"`
+	Fields []string `yaml:"fields,omitempty"`
+
+	Allocation []Variant `yaml:"allocation,omitempty"`
+}
+
+type Variant struct {
+	Name string `yaml:"name,omitempty"`
+	// Weight is relative to the weights of the other variants, so they don't
+	// need to add up to 100.
+	Weight int `yaml:"weight,omitempty"`
+
+	// Payload is returned in the feature's vars when this variant is picked.
+	Payload map[string]interface{} `yaml:"payload,omitempty"`
 }
 
 type Rules struct {
-	Enable  []EnableRule  `yaml:"enable"`
-	Disable []DisableRule `yaml:"disable"`
-	SetVars []SetVarRule  `yaml:"set_vars"`
+	Enable  []EnableRule  `yaml:"enable,omitempty"`
+	Disable []DisableRule `yaml:"disable,omitempty"`
+	SetVars []SetVarRule  `yaml:"set_vars,omitempty"`
 }
 
 type EnableRule struct {
-	Field  string   `yaml:"field"`
-	Fields []string `yaml:"fields"`
+	// ID optionally identifies the rule in explanations.
+	ID string `yaml:"id,omitempty"`
+
+	Window `yaml:",inline"`
+
+	Field  string   `yaml:"field,omitempty"`
+	Fields []string `yaml:"fields,omitempty"`
+
+	Values MatchValues `yaml:"values,omitempty"`
+	// Weight is the percentage of users the rule applies to. In 'and' mode
+	// a rule without one applies to everyone it matches, while 0 applies to
+	// no one, e.g. to pause a rollout.
+	Weight *int `yaml:"weight,omitempty"`
+	// Ramp changes Weight over time.
+	Ramp *Ramp `yaml:"ramp,omitempty"`
+	// Mode is one of the RuleMode constants.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Conditions are combined with Values, both have to match.
+	Conditions `yaml:",inline"`
+
+	// Variant forces users matched by this rule into the named variant.
+	Variant string `yaml:"variant,omitempty"`
+}
+
+// WeightOrZero returns the rule's weight, or 0 if it doesn't have one.
+func (r EnableRule) WeightOrZero() int {
+	return weightOrZero(r.Weight)
+}
 
-	Values MatchValues `yaml:"values"`
-	Weight int         `yaml:"weight"`
+// Ramp gradually changes a rule's weight over time, either linearly from
+// From at StartAt to To at EndAt, or in Steps. Users are bucketed the same way
+// at every weight, so as the weight rises everyone who already had the feature
+// keeps it.
+type Ramp struct {
+	StartAt *time.Time `yaml:"start_at,omitempty"`
+	EndAt   *time.Time `yaml:"end_at,omitempty"`
+	From    int        `yaml:"from,omitempty"`
+	To      int        `yaml:"to,omitempty"`
+
+	// Steps set the weight from each step's time onwards. Before the first
+	// step the rule's weight is used.
+	Steps []RampStep `yaml:"steps,omitempty"`
+}
+
+type RampStep struct {
+	At     time.Time `yaml:"at,omitempty"`
+	Weight int       `yaml:"weight,omitempty"`
 }
 
 type DisableRule struct {
-	Field  string   `yaml:"field"`
-	Fields []string `yaml:"fields"`
+	// ID optionally identifies the rule in explanations.
+	ID string `yaml:"id,omitempty"`
+
+	Window `yaml:",inline"`
 
-	Values MatchValues `yaml:"values"`
+	Field  string   `yaml:"field,omitempty"`
+	Fields []string `yaml:"fields,omitempty"`
+
+	Values MatchValues `yaml:"values,omitempty"`
+
+	// Conditions are combined with Values, both have to match.
+	Conditions `yaml:",inline"`
+}
+
+// Window limits when a feature or rule is active. It's active from StartAt
+// (inclusive) until EndAt (exclusive), and only during the times given by
+// Schedule. Any of these can be left out.
+type Window struct {
+	StartAt  *time.Time `yaml:"start_at,omitempty"`
+	EndAt    *time.Time `yaml:"end_at,omitempty"`
+	Schedule *Schedule  `yaml:"schedule,omitempty"`
+}
+
+// Schedule is a recurring weekly schedule.
+type Schedule struct {
+	// Days are the days of the week, e.g. 'mon' or 'monday'. Defaults to
+	// every day.
+	Days []string `yaml:"days,omitempty"`
+	// StartTime and EndTime are the time of day in 24 hour 'HH:MM' format.
+	// EndTime is exclusive and can be earlier than StartTime for schedules
+	// that run overnight, in which case Days refers to the day it starts.
+	StartTime string `yaml:"start_time,omitempty"`
+	EndTime   string `yaml:"end_time,omitempty"`
+	// TimeZone is an IANA time zone name, e.g. 'Pacific/Auckland'. Defaults
+	// to UTC.
+	TimeZone string `yaml:"time_zone,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// ParseWeekday parses a day of the week from Schedule.Days.
+func ParseWeekday(s string) (time.Weekday, error) {
+	d, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return d, errors.Errorf("unknown day '%s'", s)
+	}
+	return d, nil
+}
+
+// ParseTimeOfDay parses a time in 'HH:MM' format, returning the number of
+// minutes since midnight.
+func ParseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day '%s', expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
 }
 
 type SetVarRule struct {
-	Field  string   `yaml:"field"`
-	Fields []string `yaml:"fields"`
+	Field  string   `yaml:"field,omitempty"`
+	Fields []string `yaml:"fields,omitempty"`
+
+	Values MatchValues `yaml:"values,omitempty"`
+	// Weight is the percentage of users the rule applies to, as for
+	// EnableRule.
+	Weight *int `yaml:"weight,omitempty"`
+	// Mode is one of the RuleMode constants.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Conditions are combined with Values, both have to match.
+	Conditions `yaml:",inline"`
+
+	Set map[string]interface{} `yaml:"set,omitempty"`
+}
+
+// WeightOrZero returns the rule's weight, or 0 if it doesn't have one.
+func (r SetVarRule) WeightOrZero() int {
+	return weightOrZero(r.Weight)
+}
+
+func weightOrZero(weight *int) int {
+	if weight == nil {
+		return 0
+	}
+	return *weight
+}
+
+// Conditions combine conditions on vars into a boolean expression. Every one
+// that is set has to be true.
+type Conditions struct {
+	All []Condition `yaml:"all,omitempty"`
+	Any []Condition `yaml:"any,omitempty"`
+	Not *Condition  `yaml:"not,omitempty"`
+
+	// Segment is the name of a segment the vars have to match.
+	Segment string `yaml:"segment,omitempty"`
+}
 
-	Values MatchValues `yaml:"values"`
-	Weight int         `yaml:"weight"`
+// Condition is a node in a tree of conditions. It's true if the var called
+// Field matches Values, and all of its nested Conditions are true.
+type Condition struct {
+	Field  string      `yaml:"field,omitempty"`
+	Values MatchValues `yaml:"values,omitempty"`
 
-	Set map[string]interface{} `json:"set"`
+	Conditions `yaml:",inline"`
 }
 
+// MatchValues decides whether a var matches. Every operator that is set must
+// match. The positive operators match if the var matches any of the listed
+// values, the negative ones (neq, not_in) match if it matches none of them.
 type MatchValues struct {
-	Eq []string `json:"eq"`
+	Eq       []string `yaml:"eq,omitempty"`
+	Neq      []string `yaml:"neq,omitempty"`
+	In       []string `yaml:"in,omitempty"`     // same as eq
+	NotIn    []string `yaml:"not_in,omitempty"` // same as neq
+	Prefix   []string `yaml:"prefix,omitempty"`
+	Suffix   []string `yaml:"suffix,omitempty"`
+	Contains []string `yaml:"contains,omitempty"`
+	Regex    []string `yaml:"regex,omitempty"`
+
+	// IgnoreCase makes all of the above case-insensitive.
+	IgnoreCase bool `yaml:"ignore_case,omitempty"`
+
+	// Numeric comparisons. Vars that are JSON numbers or strings containing
+	// numbers can be compared, anything else doesn't match.
+	Gt      *float64  `yaml:"gt,omitempty"`
+	Gte     *float64  `yaml:"gte,omitempty"`
+	Lt      *float64  `yaml:"lt,omitempty"`
+	Lte     *float64  `yaml:"lte,omitempty"`
+	Between []float64 `yaml:"between,omitempty"` // [min, max], inclusive
+
+	Semver SemverMatch `yaml:"semver,omitempty"`
+}
+
+// SemverMatch compares vars as semantic versions, e.g. app versions. Vars that
+// aren't valid semantic versions don't match.
+type SemverMatch struct {
+	Eq      string   `yaml:"eq,omitempty"`
+	Gt      string   `yaml:"gt,omitempty"`
+	Gte     string   `yaml:"gte,omitempty"`
+	Lt      string   `yaml:"lt,omitempty"`
+	Lte     string   `yaml:"lte,omitempty"`
+	Between []string `yaml:"between,omitempty"` // [min, max], inclusive
+}
+
+// IsZero reports whether no operators are set.
+func (m SemverMatch) IsZero() bool {
+	return m.Eq == "" &&
+		m.Gt == "" &&
+		m.Gte == "" &&
+		m.Lt == "" &&
+		m.Lte == "" &&
+		len(m.Between) == 0
+}
+
+// IsZero reports whether no operators are set, in which case nothing matches.
+func (m MatchValues) IsZero() bool {
+	return len(m.Eq) == 0 &&
+		len(m.Neq) == 0 &&
+		len(m.In) == 0 &&
+		len(m.NotIn) == 0 &&
+		len(m.Prefix) == 0 &&
+		len(m.Suffix) == 0 &&
+		len(m.Contains) == 0 &&
+		len(m.Regex) == 0 &&
+		m.Gt == nil &&
+		m.Gte == nil &&
+		m.Lt == nil &&
+		m.Lte == nil &&
+		len(m.Between) == 0 &&
+		m.Semver.IsZero()
+}
+
+// IsZero reports whether no conditions or segment are set.
+func (c Conditions) IsZero() bool {
+	return len(c.All) == 0 && len(c.Any) == 0 && c.Not == nil && c.Segment == ""
+}
+
+// IsZero reports whether nothing is set. It's defined so that Condition
+// doesn't get the IsZero of the Conditions it embeds, which the yaml package
+// would use to leave out a 'not' that only has a field and values.
+func (c Condition) IsZero() bool {
+	return c.Field == "" && c.Values.IsZero() && c.Conditions.IsZero()
+}
+
+// RegexPattern returns the pattern to compile for the given regex, taking
+// IgnoreCase into account.
+func (m MatchValues) RegexPattern(regex string) string {
+	if m.IgnoreCase {
+		return "(?i)" + regex
+	}
+	return regex
+}
+
+// Merge policies, which decide what happens when more than one file defines
+// the same feature.
+const (
+	// MergeError rejects features defined in more than one file.
+	MergeError = "error"
+	// MergeOptIn only merges features that set Merge in every file that
+	// defines them, and rejects the rest. This is the default.
+	MergeOptIn = "opt-in"
+	// MergeAppend merges every feature defined in more than one file, as
+	// versions before merge policies did.
+	MergeAppend = "append"
+)
+
+func validateMergePolicy(policy string) error {
+	switch policy {
+	case "", MergeError, MergeOptIn, MergeAppend:
+		return nil
+	}
+	return errors.Errorf("unknown merge policy '%s', must be '%s', '%s' or '%s'", policy, MergeError, MergeOptIn, MergeAppend)
+}
+
+// checkMerge checks a can be appended to the configs loaded before it under
+// the merge policy. Files with different versions can be loaded together, as
+// each is upgraded to the latest schema, but a feature can only be merged
+// across files with the same schema version, as the versions' defaults would
+// otherwise mix within one feature.
+func checkMerge(loaded []Config, a Config, policy string) error {
+	for _, name := range a.featureNames() {
+		path := "features." + name
+		for _, c := range loaded {
+			f, ok := c.Features[name]
+			if !ok {
+				continue
+			}
+			file := c.Positions[path].File
+			var err error
+			switch {
+			case policy == MergeError:
+				err = errors.Errorf("%s: already defined in '%s', features can only be defined in one file", path, file)
+			case policy != MergeAppend && !(f.Merge && a.Features[name].Merge):
+				err = errors.Errorf("%s: already defined in '%s', set 'merge: true' in both files to merge them", path, file)
+			default:
+				err = checkMergeVersions(path, file, c.Version, a.Version)
+			}
+			if err != nil {
+				return PositionError{Position: a.Positions[path], Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+func checkMergeVersions(path, file, version, other string) error {
+	// both versions have already been checked when the files were loaded
+	v, _ := SchemaVersion(version)
+	o, _ := SchemaVersion(other)
+	if v == o {
+		return nil
+	}
+	return errors.Errorf("%s: already defined in '%s' with version '%s', a feature can only be merged across files with the same version, not '%s'",
+		path, file, version, other)
 }
 
 func (c *Config) Append(a Config) {
@@ -51,8 +488,58 @@ func (c *Config) Append(a Config) {
 	if c.Features == nil {
 		c.Features = map[string]Feature{}
 	}
+	// the positions of a's rules and requires move along with them, and are
+	// only added for what isn't already defined in c
+	positions := a.Positions
 	for name, feature := range a.Features {
 		if f, ok := c.Features[name]; ok {
+			prefix := "features." + name
+			positions = positions.shift(prefix+".requires", len(f.Requires))
+			positions = positions.shift(prefix+".rules.enable", len(f.Rules.Enable))
+			positions = positions.shift(prefix+".rules.disable", len(f.Rules.Disable))
+			positions = positions.shift(prefix+".rules.set_vars", len(f.Rules.SetVars))
+
+			if f.StartAt == nil {
+				f.StartAt = feature.StartAt
+			}
+			if f.EndAt == nil {
+				f.EndAt = feature.EndAt
+			}
+			if f.Schedule == nil {
+				f.Schedule = feature.Schedule
+			}
+			if f.Description == "" {
+				f.Description = feature.Description
+			}
+			if f.Owner == "" {
+				f.Owner = feature.Owner
+			}
+			if f.CreatedAt == nil {
+				f.CreatedAt = feature.CreatedAt
+			}
+			if f.ExpiresAt == nil {
+				f.ExpiresAt = feature.ExpiresAt
+			}
+			if f.Salt == "" {
+				f.Salt = feature.Salt
+			}
+			// version 2 files default to salted bucketing, so the
+			// bucketing is only taken from a if it's written there and
+			// not in c
+			_, inC := c.Positions[prefix+".bucketing"]
+			if _, inA := a.Positions[prefix+".bucketing"]; inA && !inC {
+				f.Bucketing = feature.Bucketing
+			}
+			if len(f.Variants.Allocation) == 0 {
+				f.Variants = feature.Variants
+			}
+			f.Requires = append(f.Requires, feature.Requires...)
+			f.Sources = append(f.Sources, feature.Sources...)
+			for _, tag := range feature.Tags {
+				if !f.HasTag(tag) {
+					f.Tags = append(f.Tags, tag)
+				}
+			}
 			f.Rules.Enable = append(f.Rules.Enable, a.Features[name].Rules.Enable...)
 			f.Rules.Disable = append(f.Rules.Disable, a.Features[name].Rules.Disable...)
 			f.Rules.SetVars = append(f.Rules.SetVars, a.Features[name].Rules.SetVars...)
@@ -61,4 +548,27 @@ func (c *Config) Append(a Config) {
 			c.Features[name] = feature
 		}
 	}
+
+	if c.Segments == nil && len(a.Segments) > 0 {
+		c.Segments = map[string]Condition{}
+	}
+	for name, segment := range a.Segments {
+		if s, ok := c.Segments[name]; ok {
+			// a segment defined in more than one file matches users who
+			// match any of the definitions
+			segment = Condition{Conditions: Conditions{Any: []Condition{s, segment}}}
+			path := "segments." + name
+			pos := c.Positions[path]
+			c.Positions = c.Positions.move(path, path+".any[0]")
+			c.Positions[path] = pos
+			positions = positions.move(path, path+".any[1]")
+		}
+		c.Segments[name] = segment
+	}
+
+	if c.Positions == nil && len(positions) > 0 {
+		c.Positions = Positions{}
+	}
+	c.Positions.add(positions)
+	c.Warnings = append(c.Warnings, a.Warnings...)
 }
@@ -0,0 +1,85 @@
+package cfg
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// EncodeYAML writes the config as a single YAML file in the latest schema
+// version, e.g. to show the effective config once files and overlays have
+// been merged. Loading the output gives the same config.
+func (c Config) EncodeYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.latest()); err != nil {
+		return errors.Wrap(err, "encode yaml")
+	}
+	return errors.Wrap(enc.Close(), "encode yaml")
+}
+
+// latest returns a copy of the config written in the latest schema version.
+// Rules from version 1 files are rewritten so they keep their meaning, and
+// the settings that only apply to separate files are dropped.
+func (c Config) latest() Config {
+	l := Config{Version: "2.0", Segments: c.Segments}
+	if len(c.Features) > 0 {
+		l.Features = map[string]Feature{}
+	}
+	for name, f := range c.Features {
+		f.Merge = false
+		f.Overlay = ""
+		f.Bucketing = latestBucketing(f.Bucketing)
+		f.Variants.Fields = latestFields(f.Variants.Field, f.Variants.Fields)
+		f.Variants.Field = ""
+
+		f.Rules.Enable = append([]EnableRule(nil), f.Rules.Enable...)
+		for i := range f.Rules.Enable {
+			rule := &f.Rules.Enable[i]
+			rule.Fields = latestFields(rule.Field, rule.Fields)
+			rule.Field = ""
+			rule.Mode = latestMode(rule.Mode)
+		}
+		f.Rules.Disable = append([]DisableRule(nil), f.Rules.Disable...)
+		for i := range f.Rules.Disable {
+			rule := &f.Rules.Disable[i]
+			rule.Fields = latestFields(rule.Field, rule.Fields)
+			rule.Field = ""
+		}
+		f.Rules.SetVars = append([]SetVarRule(nil), f.Rules.SetVars...)
+		for i := range f.Rules.SetVars {
+			rule := &f.Rules.SetVars[i]
+			rule.Fields = latestFields(rule.Field, rule.Fields)
+			rule.Field = ""
+			rule.Mode = latestMode(rule.Mode)
+		}
+		l.Features[name] = f
+	}
+	return l
+}
+
+func latestFields(field string, fields []string) []string {
+	if field != "" {
+		return []string{field}
+	}
+	return fields
+}
+
+// latestMode returns a rule's mode, which is only empty for rules from version
+// 1 files where it defaults to 'or'.
+func latestMode(mode string) string {
+	if mode == "" {
+		return RuleModeOr
+	}
+	return mode
+}
+
+// latestBucketing returns a feature's bucketing, which is only empty for
+// features from version 1 files where it defaults to 'legacy'.
+func latestBucketing(bucketing string) string {
+	if bucketing == "" {
+		return BucketingLegacy
+	}
+	return bucketing
+}
@@ -0,0 +1,194 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// interpolationRegexp matches the references in a value: '${VAR}',
+// '${VAR:-default}', '${file:path}' and '${file:path:-default}'. '$${' is an
+// escaped '${'.
+var interpolationRegexp = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// interpolate replaces the references to environment variables and files in
+// the values of a YAML config with what they refer to. It returns the YAML
+// with the references resolved and its positions, which are the ones given if
+// there weren't any. Errors are reported at the value's position in source.
+//
+// A plain (unquoted) value that is a single reference, like 'weight: ${PCT}',
+// is an integer, float or boolean if what it resolves to is written like one
+// in decimal, so it can be used for numbers and booleans. Other values with
+// references, including quoted ones, are strings.
+func interpolate(b []byte, file string, positions, source Positions) ([]byte, Positions, error) {
+	if !strings.Contains(string(b), "${") {
+		return b, positions, nil
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, yamlError(file, err, positions, source)
+	}
+	i := interpolation{dir: filepath.Dir(file)}
+	if err := i.node("", &doc); err != nil {
+		return nil, nil, source.positionError(err)
+	}
+	if !i.changed {
+		return b, positions, nil
+	}
+
+	y, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, nil, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "interpolate")}
+	}
+	var text yaml.Node
+	if err := yaml.Unmarshal(y, &text); err != nil {
+		return nil, nil, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "interpolate")}
+	}
+	positions = Positions{}
+	positions.addNode(file, "", &text, Position{File: file})
+	return y, positions, nil
+}
+
+type interpolation struct {
+	// dir is the directory of the config file, which relative file
+	// references are relative to
+	dir     string
+	changed bool
+}
+
+// node resolves the references in the values in node, which is at path.
+// Keys are left as they are.
+func (i *interpolation) node(path string, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			if err := i.node(path, n); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			key, value := node.Content[j], node.Content[j+1]
+			keyPath := key.Value
+			if key.Value == "<<" {
+				keyPath = path
+			} else if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			if err := i.node(keyPath, value); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for j, n := range node.Content {
+			if err := i.node(fmt.Sprintf("%s[%d]", path, j), n); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		value, err := i.value(node.Value)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+		node.Tag = "!!str"
+		if node.Style == 0 && isReference(node.Value) {
+			node.Tag = referenceTag(value)
+		}
+		node.Value = value
+		i.changed = true
+	}
+	// aliases refer to nodes that are resolved where they're defined
+	return nil
+}
+
+var (
+	decimalIntRegexp   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	decimalFloatRegexp = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+)
+
+// referenceTag returns the tag for what a plain value that is a single
+// reference resolved to. Only decimal numbers and 'true' and 'false' get
+// their own types, so e.g. a zero-padded '01234' stays a string, rather than
+// being read as an octal number as it would be if it were written in the file.
+func referenceTag(value string) string {
+	switch {
+	case decimalIntRegexp.MatchString(value):
+		return "!!int"
+	case decimalFloatRegexp.MatchString(value):
+		return "!!float"
+	case value == "true" || value == "false":
+		return "!!bool"
+	}
+	return "!!str"
+}
+
+// isReference reports whether s is a single reference and nothing else.
+func isReference(s string) bool {
+	loc := interpolationRegexp.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s) && s != "$${"
+}
+
+// value returns s with its references resolved.
+func (i *interpolation) value(s string) (string, error) {
+	var err error
+	value := interpolationRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		resolved, refErr := i.resolve(ref[2 : len(ref)-1])
+		if refErr != nil && err == nil {
+			err = refErr
+		}
+		return resolved
+	})
+	return value, err
+}
+
+// resolve returns the value of a reference, without its '${' and '}'.
+func (i *interpolation) resolve(ref string) (string, error) {
+	name, def := ref, ""
+	hasDefault := false
+	if j := strings.Index(ref, ":-"); j >= 0 {
+		name, def, hasDefault = ref[:j], ref[j+2:], true
+	}
+
+	if strings.HasPrefix(name, "file:") {
+		path := strings.TrimPrefix(name, "file:")
+		if path == "" {
+			return "", errors.Errorf("'${%s}' doesn't name a file", ref)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(i.dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && hasDefault {
+			return def, nil
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "read '${%s}'", ref)
+		}
+		// files usually end with a newline that isn't part of the value
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	if name == "" {
+		return "", errors.Errorf("'${%s}' doesn't name a variable", ref)
+	}
+	// as in the shell, the default is used for empty variables too
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	if hasDefault {
+		return def, nil
+	}
+	return "", errors.Errorf("environment variable '%s' isn't set, set it or give a default with '${%s:-default}'", name, name)
+}
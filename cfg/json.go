@@ -0,0 +1,187 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// loadJSON loads a JSON config file. JSON is decoded with encoding/json, as
+// the yaml package rejects some valid JSON (e.g. '\/' and escaped surrogate
+// pairs), then converted to YAML so that it's decoded and validated in exactly
+// the same way as YAML files, with errors reported at the positions in the
+// JSON. References in values are resolved if resolve is set.
+func loadJSON(r io.Reader, file string, resolve bool) (Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "read json")}
+	}
+
+	j := jsonParser{dec: json.NewDecoder(bytes.NewReader(b)), b: b, file: file, positions: Positions{}}
+	j.dec.UseNumber()
+	v, err := j.document()
+	if err != nil {
+		return Config{}, j.error(err)
+	}
+
+	y, err := convertedYAML(v)
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "convert json")}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(y, &doc); err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "convert json")}
+	}
+	positions := Positions{}
+	positions.addNode(file, "", &doc, Position{File: file})
+	return decodeConfig(y, file, positions, j.positions, b, resolve)
+}
+
+// jsonParser decodes a JSON document token by token, to find the positions
+// of everything in it along the way.
+type jsonParser struct {
+	dec       *json.Decoder
+	b         []byte
+	file      string
+	positions Positions
+}
+
+// document decodes the whole document, which has to be a single value.
+func (j *jsonParser) document() (interface{}, error) {
+	tok, _, err := j.next()
+	if err != nil {
+		return nil, err
+	}
+	v, err := j.value("", tok)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := j.dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("invalid character after top-level value")
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// next returns the next token and where it starts.
+func (j *jsonParser) next() (json.Token, Position, error) {
+	// the offset is where the previous token ended, so skip the whitespace
+	// and separators before this one
+	off := int(j.dec.InputOffset())
+	for off < len(j.b) && bytes.IndexByte([]byte(" \t\r\n,:"), j.b[off]) >= 0 {
+		off++
+	}
+	pos := j.position(off)
+	tok, err := j.dec.Token()
+	return tok, pos, err
+}
+
+// value decodes the value that starts with tok, which is at path. The
+// positions of map values are the positions of their keys, as in YAML.
+func (j *jsonParser) value(path string, tok json.Token) (interface{}, error) {
+	switch tok {
+	case json.Delim('{'):
+		m := map[string]interface{}{}
+		for j.dec.More() {
+			key, pos, err := j.next()
+			if err != nil {
+				return nil, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid object key %v", key)
+			}
+			keyPath := k
+			if path != "" {
+				keyPath = path + "." + k
+			}
+			j.positions[keyPath] = pos
+			tok, _, err := j.next()
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = j.value(keyPath, tok); err != nil {
+				return nil, err
+			}
+		}
+		_, err := j.dec.Token()
+		return m, err
+	case json.Delim('['):
+		l := []interface{}{}
+		for i := 0; j.dec.More(); i++ {
+			tok, pos, err := j.next()
+			if err != nil {
+				return nil, err
+			}
+			item := fmt.Sprintf("%s[%d]", path, i)
+			j.positions[item] = pos
+			v, err := j.value(item, tok)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		_, err := j.dec.Token()
+		return l, err
+	}
+	if n, ok := tok.(json.Number); ok {
+		// keep integers as integers, so they decode as they would in YAML
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		return n.Float64()
+	}
+	return tok, nil
+}
+
+// position returns the line and column of an offset in the file.
+func (j *jsonParser) position(off int) Position {
+	if off > len(j.b) {
+		off = len(j.b)
+	}
+	line := 1 + bytes.Count(j.b[:off], []byte("\n"))
+	start := bytes.LastIndexByte(j.b[:off], '\n') + 1
+	return Position{File: j.file, Line: line, Column: 1 + utf8.RuneCount(j.b[start:off])}
+}
+
+// error adds the position to an error decoding the file, if it has one.
+func (j *jsonParser) error(err error) error {
+	pos := Position{File: j.file}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		pos = j.position(int(syntaxErr.Offset))
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("unexpected end of JSON input")
+		pos = j.position(len(j.b))
+	}
+	return PositionError{Position: pos, Err: errors.Wrap(err, "read json")}
+}
+
+// convertedYAML returns v, decoded from another format, as YAML text. Strings
+// are quoted, as they were in the other format, so they stay strings if a
+// reference in them resolves to something that looks like a number.
+func convertedYAML(v interface{}) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(v); err != nil {
+		return nil, err
+	}
+	quoteStrings(&node)
+	return yaml.Marshal(&node)
+}
+
+func quoteStrings(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	for _, n := range node.Content {
+		quoteStrings(n)
+	}
+}
@@ -1,45 +1,324 @@
 package cfg
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
-	"os"
+	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/pelletier/go-toml/v2"
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+// LoadYAML decodes and validates a YAML config. Unknown keys are rejected, so a
+// typo like 'weigth' fails the load instead of silently being ignored.
 func LoadYAML(r io.Reader) (Config, error) {
-	dec := yaml.NewDecoder(r)
+	return loadYAML(r, "", true)
+}
+
+// loadFile loads a config file in any of the supported formats, which are
+// YAML, JSON and TOML. Errors are PositionErrors giving where in the file they
+// are, and the config's Positions are set. References in values are resolved
+// if resolve is set.
+func loadFile(r io.Reader, file string, resolve bool) (Config, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		return loadTOML(r, file, resolve)
+	case ".json":
+		return loadJSON(r, file, resolve)
+	}
+	return loadYAML(r, file, resolve)
+}
+
+// loadYAML loads a YAML config file, resolving the references to environment
+// variables and files in its values if resolve is set.
+func loadYAML(r io.Reader, file string, resolve bool) (Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "read yaml")}
+	}
+
+	// the yaml package can only reject unknown keys when decoding straight
+	// from the bytes, so the nodes are decoded separately for their
+	// positions
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return Config{}, yamlError(file, err, nil, nil)
+	}
+	positions := Positions{}
+	positions.addNode(file, "", &doc, Position{File: file})
+	cfg, err := decodeConfig(b, file, positions, positions, b, resolve)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Warnings = boolWarnings(file, "", &doc)
+	return cfg, nil
+}
+
+// decodeConfig decodes and validates a config from YAML text. positions are
+// the positions in the text, and source are the positions errors are reported
+// at, which differ when the text was converted from another format. The
+// revision is the hash of raw, the file as it was read, and of the values its
+// references to environment variables and files resolved to. References are
+// only resolved if resolve is set.
+func decodeConfig(b []byte, file string, positions, source Positions, raw []byte, resolve bool) (Config, error) {
 	cfg := Config{}
-	err := dec.Decode(&cfg)
-	return cfg, errors.Wrap(err, "read yaml")
+	interpolated := b
+	if resolve {
+		var err error
+		interpolated, positions, err = interpolate(b, file, positions, source)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(interpolated))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, yamlError(file, err, positions, source)
+	}
+	revision := sha256.New()
+	revision.Write(raw)
+	if !bytes.Equal(interpolated, b) {
+		revision.Write(interpolated)
+	}
+	cfg.Revision = fmt.Sprintf("%x", revision.Sum(nil))
+	cfg.Positions = source
+	if err := cfg.upgrade(); err != nil {
+		return cfg, source.positionError(err)
+	}
+	return cfg, source.positionError(cfg.Validate())
 }
 
+// LoadYAMLDir loads every config file in a directory and merges them, without
+// any environment's overlays. Despite the name, JSON and TOML files are loaded
+// too.
 func LoadYAMLDir(filePath string) (Config, error) {
+	return LoadDir(filePath, "", MergeOptIn)
+}
+
+// LoadDir loads every config file in a directory and merges them according to
+// the merge policy (one of the Merge constants, defaulting to MergeOptIn),
+// then applies the overlay files for env (see ApplyOverlay). Overlay files are
+// the ones that set an environment. Overlays for other environments, or every
+// overlay if env is empty, are skipped without resolving their references, so
+// they can refer to secrets that only exist where they're used.
+func LoadDir(filePath, env, merge string) (Config, error) {
+	return loadDir(filePath, env, merge, true, nil)
+}
+
+// LoadDirUnresolved loads a directory like LoadDir, but leaves the references
+// to environment variables and files in values as they're written. It's for
+// checking a config where what it refers to doesn't exist, e.g. in CI. As the
+// references aren't resolved, they're only valid in settings that are strings.
+func LoadDirUnresolved(filePath, env, merge string) (Config, error) {
+	return loadDir(filePath, env, merge, false, nil)
+}
+
+// loadDir loads a directory like LoadDir. The files in contents are loaded
+// from there instead of from the directory.
+func loadDir(filePath, env, merge string, resolve bool, contents map[string][]byte) (Config, error) {
 	cfg := Config{}
+	if err := validateMergePolicy(merge); err != nil {
+		return cfg, err
+	}
+	files, data, envs, err := readDir(filePath, contents)
+	if err != nil {
+		return cfg, err
+	}
+	declared := map[string]bool{}
+	for _, e := range envs {
+		declared[e] = true
+	}
+
+	// keep each file's config so undefined segments and features can be
+	// reported against the file they're used in
+	var configs, bases, overlays []Config
+	revision := sha256.New()
+	for _, path := range files {
+		c, ok, err := loadPath(path, data[path], env, resolve, declared)
+		if err != nil {
+			return cfg, err
+		}
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(filePath, path)
+		if err != nil {
+			return cfg, err
+		}
+		for name, feature := range c.Features {
+			feature.Sources = []string{rel}
+			c.Features[name] = feature
+		}
+		configs = append(configs, c)
+		// the revision covers the file names as well as their contents,
+		// so renaming or removing a file changes it too
+		fmt.Fprintf(revision, "%s\n%s\n", rel, c.Revision)
+
+		if c.Environment != "" {
+			overlays = append(overlays, c)
+			continue
+		}
+		if err := checkMerge(bases, c, merge); err != nil {
+			return cfg, err
+		}
+		bases = append(bases, c)
+		cfg.Append(c)
+	}
+	// overlays are applied once the base config is complete, so they can
+	// change features defined in any file
+	for _, o := range overlays {
+		cfg.ApplyOverlay(o)
+	}
+
+	for _, c := range configs {
+		if err := c.ValidateRefs(cfg); err != nil {
+			return cfg, c.Positions.positionError(err)
+		}
+	}
+	cfg.Revision = fmt.Sprintf("%x", revision.Sum(nil))
+	if err := cfg.validateVariants(); err != nil {
+		return cfg, cfg.Positions.positionError(err)
+	}
+	if err := cfg.validateRequires(); err != nil {
+		return cfg, cfg.Positions.positionError(err)
+	}
+	if env != "" && !declared[env] {
+		// most likely a typo, e.g. 'prd', which would otherwise quietly
+		// run the base config
+		cfg.Warnings = append(cfg.Warnings, errors.Errorf("no overlay files set 'environment: %s', so none are applied", env))
+	}
+	cfg.Warnings = append(cfg.Warnings, cfg.expiredWarnings(time.Now())...)
+	return cfg, nil
+}
+
+// Files returns the config files in a directory and the directories under it
+// that LoadDir loads, in lexical order.
+func Files(filePath string) ([]string, error) {
+	var files []string
 	err := filepath.Walk(filePath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
+			// Kubernetes mounts ConfigMaps with the real files in a hidden,
+			// timestamped directory (e.g. '..2021_03_01_00_00_00.123') and
+			// symlinks to them from the top level, so skip hidden directories
+			// to avoid loading everything twice.
+			if path != filePath && isHidden(info) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		switch strings.ToLower(filepath.Ext(path)) {
-		case ".yaml", ".yml":
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+		case ".yaml", ".yml", ".json", ".toml":
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Environments returns the environments that the overlay files in a
+// directory are for, sorted.
+func Environments(filePath string) ([]string, error) {
+	_, _, envs, err := readDir(filePath, nil)
+	return envs, err
+}
 
-			c, err := LoadYAML(f)
-			if err != nil {
-				return err
+// readDir reads the config files in a directory, taking the ones in contents
+// from there instead, and returns them along with the environments that the
+// overlay files are for, sorted.
+func readDir(filePath string, contents map[string][]byte) ([]string, map[string][]byte, []string, error) {
+	files, err := Files(filePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	data := map[string][]byte{}
+	seen := map[string]bool{}
+	var envs []string
+	for _, path := range files {
+		b, ok := contents[path]
+		if !ok {
+			if b, err = ioutil.ReadFile(path); err != nil {
+				return nil, nil, nil, err
 			}
-			cfg.Append(c)
 		}
+		data[path] = b
+		if e := fileEnvironment(b, path); e != "" && !seen[e] {
+			seen[e] = true
+			envs = append(envs, e)
+		}
+	}
+	sort.Strings(envs)
+	return files, data, envs, nil
+}
 
-		return nil
-	})
-	return cfg, err
+// loadPath loads the config file at path, which contains b. ok is false if
+// the file is an overlay for an environment other than env, in which case it
+// isn't loaded. A file named like an overlay for one of the declared
+// environments (e.g. 'stripe.prod.yaml' when another file sets 'environment:
+// prod') has to set its environment too, so a forgotten 'environment' doesn't
+// load an overlay into every environment.
+func loadPath(path string, b []byte, env string, resolve bool, declared map[string]bool) (c Config, ok bool, err error) {
+	if e := fileEnvironment(b, path); e != "" && e != env {
+		return c, false, nil
+	}
+	c, err = loadFile(bytes.NewReader(b), path, resolve)
+	if err != nil {
+		return c, false, err
+	}
+	if e := nameEnvironment(path); declared[e] && c.Environment == "" {
+		return c, false, PositionError{
+			Position: Position{File: path},
+			Err:      errors.Errorf("file is named like an overlay for '%s', set 'environment: %s' to make it one, or rename it", e, e),
+		}
+	}
+	return c, true, nil
+}
+
+// nameEnvironment returns the environment a file is named like an overlay
+// for, which is the part of its name between the last two dots, e.g. 'prod'
+// for 'stripe.prod.yaml'. It's empty for names without one.
+func nameEnvironment(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if i := strings.LastIndex(name, "."); i > 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// fileEnvironment returns the environment a config file is an overlay for,
+// which is empty for base files. Only the environment is decoded, so nothing
+// else in the file is resolved or validated. Files that can't be decoded are
+// treated as base files, so loading them reports the error.
+func fileEnvironment(b []byte, file string) string {
+	var c struct {
+		Environment string `yaml:"environment" toml:"environment" json:"environment"`
+	}
+	var err error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(b, &c)
+	case ".json":
+		err = json.Unmarshal(b, &c)
+	default:
+		err = yaml.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return ""
+	}
+	return c.Environment
+}
+
+func isHidden(info fs.FileInfo) bool {
+	return strings.HasPrefix(info.Name(), ".")
 }
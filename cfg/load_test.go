@@ -1,16 +1,39 @@
 package cfg_test
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	. "github.com/dylannz/feature-service/cfg"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
+func weight(w int) *int {
+	return &w
+}
+
 var _ = Describe("cfg", func() {
+	Describe("LoadYAML", func() {
+		It("reports the line of syntax errors", func() {
+			_, err := LoadYAML(strings.NewReader("version: 1.0\nfeatures:\n  a:\n   b: [\n"))
+			Expect(err).To(MatchError("4: did not find expected node content"))
+			Expect(err).To(BeAssignableToTypeOf(PositionError{}))
+		})
+	})
+
 	Describe("LoadYAMLDir", func() {
 		It("loads all the yml files from a given directory", func() {
 			cfg, err := LoadYAMLDir("./fixtures/dir")
 			Expect(err).NotTo(HaveOccurred())
+			// the revision and positions are checked separately
+			cfg.Revision = ""
+			cfg.Positions = nil
 			Expect(cfg).To(Equal(Config{
 				Version: "1.0",
 				Features: map[string]Feature{
@@ -19,13 +42,13 @@ var _ = Describe("cfg", func() {
 							Enable: []EnableRule{
 								{
 									Fields: []string{"email", "customer_id"},
-									Weight: 10,
+									Weight: weight(10),
 								},
 							},
 							SetVars: []SetVarRule{
 								{
 									Fields: []string{"customer_id"},
-									Weight: 50,
+									Weight: weight(50),
 									Set: map[string]interface{}{
 										"int_key":    1337,
 										"string_key": "my_string_value",
@@ -33,6 +56,7 @@ var _ = Describe("cfg", func() {
 								},
 							},
 						},
+						Sources: []string{"profile.yml"},
 					},
 					"stripe_billing": {
 						Rules: Rules{
@@ -40,7 +64,7 @@ var _ = Describe("cfg", func() {
 								{
 									Field:  "customer_id",
 									Values: MatchValues{Eq: []string{"123", "456"}},
-									Weight: 50,
+									Weight: weight(50),
 								},
 								{
 									Field:  "customer_id",
@@ -58,9 +82,525 @@ var _ = Describe("cfg", func() {
 								},
 							},
 						},
+						Merge:   true,
+						Sources: []string{"stripe.yaml", "stripe2.yml"},
+					},
+				},
+			}))
+		})
+
+		It("records where everything was loaded from", func() {
+			cfg, err := LoadYAMLDir("./fixtures/dir")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Positions["features.stripe_billing"]).To(Equal(Position{File: "fixtures/dir/stripe.yaml", Line: 5, Column: 3}))
+			Expect(cfg.Positions["features.stripe_billing.rules.disable[1].values.eq[0]"]).To(Equal(Position{File: "fixtures/dir/stripe2.yml", Line: 17, Column: 17}))
+		})
+
+		It("loads variants", func() {
+			cfg, err := LoadYAMLDir("./fixtures/variants")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["profile_page_v2"].Variants).To(Equal(Variants{
+				Field: "customer_id",
+				Allocation: []Variant{
+					{Name: "control", Weight: 50},
+					{
+						Name:    "compact",
+						Weight:  50,
+						Payload: map[string]interface{}{"columns": 2},
+					},
+				},
+			}))
+		})
+
+		It("loads time windows", func() {
+			cfg, err := LoadYAMLDir("./fixtures/windows")
+			Expect(err).NotTo(HaveOccurred())
+			nz := time.FixedZone("", 12*60*60)
+			startAt := time.Date(2021, 6, 1, 0, 0, 0, 0, nz)
+			endAt := time.Date(2021, 7, 1, 0, 0, 0, 0, nz)
+			ruleStartAt := time.Date(2021, 6, 15, 0, 0, 0, 0, nz)
+			feature := cfg.Features["weekend_sale"]
+			Expect(feature.Window).To(Equal(Window{
+				StartAt: &startAt,
+				EndAt:   &endAt,
+				Schedule: &Schedule{
+					Days:      []string{"sat", "sun"},
+					StartTime: "09:00",
+					EndTime:   "17:00",
+					TimeZone:  "Pacific/Auckland",
+				},
+			}))
+			Expect(feature.Rules.Enable[0].Window).To(Equal(Window{StartAt: &ruleStartAt}))
+		})
+
+		It("merges segments defined in several files", func() {
+			cfg, err := LoadYAMLDir("./fixtures/segments")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Segments).To(Equal(map[string]Condition{
+				"beta_customers": {
+					Conditions: Conditions{
+						Any: []Condition{
+							{Field: "customer_id", Values: MatchValues{In: []string{"123", "456"}}},
+							{Field: "customer_id", Values: MatchValues{In: []string{"789"}}},
+						},
 					},
 				},
 			}))
+			Expect(cfg.Features["reports_v2"].Rules.Enable).To(Equal([]EnableRule{
+				{Conditions: Conditions{Segment: "beta_customers"}},
+			}))
+			Expect(cfg.Positions["segments.beta_customers.any[0].values.in"].File).To(HaveSuffix("segments_a.yml"))
+			Expect(cfg.Positions["segments.beta_customers.any[1].values.in"].File).To(HaveSuffix("segments_b.yml"))
+		})
+
+		It("loads prerequisites", func() {
+			cfg, err := LoadYAMLDir("./fixtures/prerequisites")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["checkout_v3"].Requires).To(Equal([]Prerequisite{
+				{Feature: "payments_v2"},
+				{Feature: "payments_v2", Variant: "treatment"},
+			}))
+		})
+
+		It("changes the revision when the files change", func() {
+			dir, err := ioutil.TempDir("", "revision")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			revision := func() string {
+				cfg, err := LoadYAMLDir(dir)
+				Expect(err).NotTo(HaveOccurred())
+				return cfg.Revision
+			}
+			writeFile := func(name, contents string) {
+				Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)).To(Succeed())
+			}
+
+			writeFile("a.yml", "version: 1.0\n")
+			first := revision()
+			Expect(revision()).To(Equal(first))
+
+			writeFile("a.yml", "version: 1.0\nfeatures: {}\n")
+			second := revision()
+			Expect(second).NotTo(Equal(first))
+
+			Expect(os.Rename(filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml"))).To(Succeed())
+			Expect(revision()).NotTo(Equal(second))
+		})
+
+		It("merges feature metadata", func() {
+			cfg, err := LoadYAMLDir("./fixtures/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			createdAt := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+			expiresAt := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+			feature := cfg.Features["checkout_v3"]
+			Expect(feature.Description).To(Equal("The new one page checkout"))
+			Expect(feature.Owner).To(Equal("team-payments"))
+			Expect(feature.Tags).To(Equal([]string{"checkout", "web"}))
+			Expect(feature.CreatedAt).To(Equal(&createdAt))
+			Expect(feature.ExpiresAt).To(Equal(&expiresAt))
+			Expect(feature.Rules.Enable).To(HaveLen(2))
+
+			Expect(cfg.Expired(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))).To(BeEmpty())
+			Expect(cfg.Expired(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC))).To(Equal([]string{"search_v2"}))
+			Expect(cfg.Expired(time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC))).To(Equal([]string{"checkout_v3", "search_v2"}))
+		})
+
+		It("warns about expired features", func() {
+			cfg, err := LoadYAMLDir("./fixtures/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Warnings).To(HaveLen(2))
+			Expect(cfg.Warnings[0]).To(MatchError(
+				"fixtures/metadata/b.yml:8:5: features.checkout_v3.expires_at: feature 'checkout_v3' expired at " +
+					"2021-09-01T00:00:00Z and should be removed from the config by its owner 'team-payments'",
+			))
+			Expect(cfg.Warnings[1]).To(MatchError(HavePrefix(
+				"fixtures/metadata/a.yml:18:5: features.search_v2.expires_at: feature 'search_v2' expired",
+			)))
+		})
+
+		It("rejects features defined in more than one file unless they opt in to merging", func() {
+			_, err := LoadYAMLDir("./fixtures/duplicate_feature")
+			Expect(err).To(MatchError(
+				"fixtures/duplicate_feature/b.yml:5:3: features.stripe_billing: already defined in " +
+					"'fixtures/duplicate_feature/a.yml', set 'merge: true' in both files to merge them",
+			))
+		})
+
+		It("rejects features defined in more than one file with the error merge policy", func() {
+			_, err := LoadDir("./fixtures/metadata", "", MergeError)
+			Expect(err).To(MatchError(
+				"fixtures/metadata/b.yml:5:3: features.checkout_v3: already defined in " +
+					"'fixtures/metadata/a.yml', features can only be defined in one file",
+			))
+		})
+
+		It("merges features defined in more than one file with the append merge policy", func() {
+			cfg, err := LoadDir("./fixtures/duplicate_feature", "", MergeAppend)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["stripe_billing"].Rules.Enable).To(HaveLen(2))
+		})
+
+		It("rejects unknown merge policies", func() {
+			_, err := LoadDir("./fixtures/dir", "", "merge")
+			Expect(err).To(MatchError("unknown merge policy 'merge', must be 'error', 'opt-in' or 'append'"))
+		})
+
+		It("rejects merging a feature across files with different versions", func() {
+			for _, merge := range []string{MergeOptIn, MergeAppend} {
+				_, err := LoadDir("./fixtures/merge_versions", "", merge)
+				Expect(err).To(MatchError(
+					"fixtures/merge_versions/b.yml:5:3: features.search_v2: already defined in " +
+						"'fixtures/merge_versions/a.yml' with version '1.0', a feature can only be merged " +
+						"across files with the same version, not '2.0'",
+				))
+			}
+		})
+
+		It("loads files with different versions together", func() {
+			cfg, err := LoadYAMLDir("./fixtures/mixed_versions")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["stripe_billing"].Rules.Enable[0].Mode).To(BeEmpty())
+			Expect(cfg.Features["search_v2"].Rules.Enable[0].Mode).To(Equal(RuleModeAnd))
+		})
+
+		It("defaults to legacy bucketing in version 1 files and salted in version 2", func() {
+			cfg, err := LoadDir("./fixtures/bucketing", "prod", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			// the version 2 overlay doesn't change the version 1 feature's
+			Expect(cfg.Features["stripe_billing"].Bucketing).To(BeEmpty())
+			Expect(cfg.Features["stripe_billing"].Owner).To(Equal("team-billing"))
+			Expect(cfg.Features["search_v2"].Bucketing).To(Equal(BucketingSalted))
+			Expect(cfg.Features["search_v3"].Salt).To(Equal("search_v2"))
+			Expect(cfg.Features["stripe_invoices"].Bucketing).To(Equal(BucketingSalted))
+		})
+
+		It("loads JSON and TOML files the same way as YAML files", func() {
+			cfg, err := LoadYAMLDir("./fixtures/formats")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features).To(HaveLen(3))
+
+			yamlFeature := cfg.Features["yaml_feature"]
+			yamlFeature.Sources = nil
+			for _, name := range []string{"json_feature", "toml_feature"} {
+				feature := cfg.Features[name]
+				feature.Sources = nil
+				Expect(feature).To(Equal(yamlFeature), name)
+			}
+			Expect(cfg.Positions["features.toml_feature.rules.enable[1].all[0].values"]).To(Equal(
+				Position{File: "fixtures/formats/toml.toml", Line: 21, Column: 29},
+			))
+		})
+
+		It("loads JSON that YAML can't read", func() {
+			cfg, err := LoadYAMLDir("./fixtures/json_escapes")
+			Expect(err).NotTo(HaveOccurred())
+			feature := cfg.Features["launch"]
+			Expect(feature.Rules.Enable[0].Values.Eq).To(Equal([]string{"a/b"}))
+			Expect(feature.Rules.SetVars[0].Set).To(Equal(map[string]interface{}{"icon": "\U0001F680"}))
+			Expect(cfg.Positions["features.launch.rules.set_vars[0].set.icon"]).To(Equal(
+				Position{File: "fixtures/json_escapes/escapes.json", Line: 10, Column: 63},
+			))
+		})
+
+		It("reports the position of errors in JSON and TOML files", func() {
+			_, err := LoadYAMLDir("./fixtures/invalid_toml")
+			Expect(err).To(MatchError(ContainSubstring(
+				"bad.toml:12:1: features.toml_feature.rules.enable[1].weigth: field weigth not found in type cfg.EnableRule",
+			)))
+			_, err = LoadYAMLDir("./fixtures/invalid_json")
+			Expect(err).To(MatchError(ContainSubstring(
+				"bad.json:7:34: features.json_feature.rules.enable[0].weight: weight (150) outside range 0-100",
+			)))
+		})
+
+		It("warns about unquoted YAML 1.1 booleans in payloads", func() {
+			cfg, err := LoadYAMLDir("./fixtures/yaml11_bools")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["checkout_v2"].Rules.SetVars[0].Set["beta"]).To(Equal("yes"))
+			Expect(cfg.Warnings).To(HaveLen(2))
+			Expect(cfg.Warnings[0]).To(MatchError(HavePrefix(
+				"fixtures/yaml11_bools/flags.yml:12:22: features.checkout_v2.variants.allocation[0].payload.express: 'on' is a string",
+			)))
+			Expect(cfg.Warnings[1]).To(MatchError(HavePrefix(
+				"fixtures/yaml11_bools/flags.yml:21:19: features.checkout_v2.rules.set_vars[0].set.beta: 'yes' is a string",
+			)))
+		})
+
+		It("loads condition trees", func() {
+			cfg, err := LoadYAMLDir("./fixtures/conditions")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["checkout_v3"].Rules.Enable).To(Equal([]EnableRule{
+				{
+					Conditions: Conditions{
+						All: []Condition{
+							{
+								Field:  "country",
+								Values: MatchValues{Eq: []string{"NZ"}},
+							},
+							{
+								Conditions: Conditions{
+									Any: []Condition{
+										{
+											Field:  "customer_id",
+											Values: MatchValues{In: []string{"123", "456"}},
+										},
+										{
+											Field:  "plan",
+											Values: MatchValues{Eq: []string{"enterprise"}},
+										},
+									},
+								},
+							},
+						},
+						Not: &Condition{
+							Field:  "internal",
+							Values: MatchValues{Eq: []string{"true"}},
+						},
+					},
+				},
+			}))
+		})
+
+		DescribeTable("rejects invalid configs, naming the file",
+			func(dir, message string) {
+				_, err := LoadYAMLDir(filepath.Join("./fixtures", dir))
+				Expect(err).To(MatchError(And(
+					ContainSubstring("bad.yml"),
+					ContainSubstring(message),
+				)))
+			},
+			Entry("unknown keys", "unknown_key", "bad.yml:9:11: features.stripe_billing.rules.enable[0].weigth: field weigth not found in type cfg.EnableRule"),
+			Entry("both field and fields", "field_and_fields", "bad.yml:8:11: features.stripe_billing.rules.disable[0]: use either field or fields, not both"),
+			Entry("values without fields", "missing_fields", "bad.yml:8:11: features.stripe_billing.rules.enable[0]: values need a field or fields to match"),
+			Entry("weights outside 0-100", "invalid_weight", "bad.yml:9:11: features.stripe_billing.rules.enable[0].weight: weight (150) outside range 0-100"),
+			Entry("set_vars with nothing to set", "empty_set", "bad.yml:11:11: features.stripe_billing.rules.set_vars[0].set: no vars to set"),
+			Entry("unknown bucketing", "invalid_bucketing", "bad.yml:6:5: features.stripe_billing.bucketing: unknown bucketing 'legcy', must be 'salted' or 'legacy'"),
+			Entry("salts with legacy bucketing", "legacy_salt", "bad.yml:7:5: features.stripe_billing.salt: salt is only used with 'bucketing: salted'"),
+			Entry("duplicate variants", "duplicate_variant", "bad.yml:10:11: features.stripe_billing.variants.allocation[1].name: duplicate variant 'control'"),
+			Entry("undefined variants", "undefined_variant", "bad.yml:17:11: features.stripe_billing.rules.enable[0].variant: feature 'stripe_billing' has no variant 'treatmnet'"),
+			Entry("invalid regexes", "invalid_regex", "bad.yml:10:13: features.internal_tools.rules.enable[0].values.regex: error parsing regexp: missing closing ): `@example\\.(com`"),
+			Entry("invalid semantic versions", "invalid_semver", "bad.yml:10:13: features.new_onboarding.rules.enable[0].values.semver: invalid semantic version: 'four'"),
+			Entry("unknown time zones", "invalid_schedule", "bad.yml:9:7: features.weekend_sale.schedule.time_zone: unknown time zone Pacific/Atlantis"),
+			Entry("ramps with steps out of order", "invalid_ramp", "bad.yml:9:11: features.search_v2.rules.enable[0].ramp: steps[1]: steps must be in time order"),
+			Entry("unknown rule modes", "invalid_mode", "bad.yml:9:11: features.stripe_billing.rules.enable[0].mode: unknown mode 'xor', must be 'or' or 'and'"),
+			Entry("conditions with a field but no values", "invalid_condition", "bad.yml:9:15: features.checkout_v3.rules.disable[0].any[0]: field needs values to match"),
+			Entry("undefined segments", "undefined_segment", "bad.yml:17:15: features.reports_v2.rules.enable[0].any[1].segment: undefined segment 'staff'"),
+			Entry("segments that refer to other segments", "nested_segment", "bad.yml:15:9: segments.nz_beta_customers.all[1].segment: segments can't refer to other segments"),
+			Entry("features that require each other", "prerequisite_cycle", "bad.yml:12:5: features.billing_v2.requires: cycle: billing_v2 -> checkout_v3 -> payments_v2 -> billing_v2"),
+			Entry("undefined prerequisites", "undefined_prerequisite", "bad.yml:7:9: features.checkout_v3.requires[0]: undefined feature 'payments_v2'"),
+			Entry("undefined prerequisite variants", "undefined_prerequisite_variant", "bad.yml:7:9: features.checkout_v3.requires[0]: feature 'payments_v2' has no variant 'treatment'"),
+			Entry("unknown versions", "unknown_version", "bad.yml:1:1: version: unknown version '3.0', must be '1.0' or '2.0'"),
+			Entry("field in version 2 rules", "v2_field", "bad.yml:8:11: features.search_v2.rules.enable[0].field: use fields in version 2.0"),
+			Entry("'and' mode rules that match everyone", "untargeted_rule", "bad.yml:8:11: features.search_v2.rules.enable[0]: rule in 'and' mode needs values, conditions, a weight or a ramp, or it matches everyone"),
+			Entry("variants without fields to pick them", "variant_without_fields", "bad.yml:14:11: features.checkout_v3.rules.enable[0]: rule has no fields to pick a variant with, set variants.fields"),
+		)
+	})
+
+	Describe("interpolation", func() {
+		BeforeEach(func() {
+			os.Setenv("FS_TEST_CUSTOMER", "123")
+			os.Setenv("FS_TEST_API_HOST", "api.example.com")
+			os.Setenv("FS_TEST_WEIGHT", "25")
+			os.Setenv("FS_TEST_ZIP", "01234")
+			os.Setenv("FS_TEST_ACCOUNT", "1e5")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("FS_TEST_CUSTOMER")
+			os.Unsetenv("FS_TEST_API_HOST")
+			os.Unsetenv("FS_TEST_WEIGHT")
+			os.Unsetenv("FS_TEST_ZIP")
+			os.Unsetenv("FS_TEST_ACCOUNT")
+		})
+
+		It("resolves environment variables and files in values", func() {
+			cfg, err := LoadYAMLDir("./fixtures/interpolation")
+			Expect(err).NotTo(HaveOccurred())
+			feature := cfg.Features["checkout_v2"]
+			Expect(feature.Rules.Enable[0].Values.In).To(Equal([]string{"123", "customer-123"}))
+			Expect(feature.Rules.Enable[0].Weight).To(Equal(weight(25)))
+			Expect(feature.Rules.SetVars[0].Set).To(Equal(map[string]interface{}{
+				"endpoint":    "https://api.example.com/v1",
+				"port":        8080,
+				"region":      "",
+				"api_key":     "secret-key",
+				"fallback":    "none",
+				"template":    "${FS_TEST_API_HOST}",
+				"quoted_port": "8080",
+				"zip":         "01234",
+			}))
+			Expect(cfg.Features["billing_v2"].Rules.SetVars[0].Set).To(Equal(map[string]interface{}{
+				"zip":     "01234",
+				"account": "1e5",
+			}))
+			Expect(cfg.Positions["features.checkout_v2.rules.set_vars[0].set.api_key"]).To(Equal(
+				Position{File: "fixtures/interpolation/checkout.yaml", Line: 18, Column: 13},
+			))
+		})
+
+		It("changes the revision when the values change", func() {
+			before, err := LoadYAMLDir("./fixtures/interpolation")
+			Expect(err).NotTo(HaveOccurred())
+			os.Setenv("FS_TEST_API_HOST", "api2.example.com")
+			after, err := LoadYAMLDir("./fixtures/interpolation")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.Revision).NotTo(Equal(before.Revision))
+		})
+
+		It("rejects references that can't be resolved", func() {
+			_, err := LoadYAMLDir("./fixtures/unset_variable")
+			Expect(err).To(MatchError(ContainSubstring(
+				"bad.yml:9:13: features.checkout_v2.rules.set_vars[0].set.endpoint: environment variable 'FS_TEST_UNSET' isn't set",
+			)))
+		})
+	})
+
+	Describe("LoadDir", func() {
+		It("ignores overlays without an environment", func() {
+			cfg, err := LoadDir("./fixtures/overlays", "", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features).To(HaveLen(2))
+			Expect(cfg.Features["checkout_v2"].Owner).To(Equal("payments"))
+			Expect(cfg.Features["checkout_v2"].Sources).To(Equal([]string{"checkout.yaml"}))
+		})
+
+		It("patches features with the environment's overlays", func() {
+			cfg, err := LoadDir("./fixtures/overlays", "prod", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features).To(HaveLen(3))
+
+			checkout := cfg.Features["checkout_v2"]
+			Expect(checkout.Owner).To(Equal("payments-oncall"))
+			Expect(checkout.Tags).To(Equal([]string{"web"}))
+			Expect(checkout.Rules.Enable).To(Equal([]EnableRule{
+				{ID: "beta", Fields: []string{"customer_id"}, Weight: weight(100), Mode: RuleModeAnd},
+				{ID: "staff", Mode: RuleModeAnd, Conditions: Conditions{Segment: "staff"}},
+				{ID: "nz", Fields: []string{"country"}, Values: MatchValues{Eq: []string{"nz"}}, Mode: RuleModeAnd},
+			}))
+			Expect(checkout.Rules.Disable).To(HaveLen(1))
+			Expect(checkout.Sources).To(Equal([]string{"checkout.yaml", "checkout.prod.yaml"}))
+
+			Expect(cfg.Features["express_pay"].Rules.Enable).To(BeEmpty())
+			Expect(cfg.Features["express_pay"].Rules.Disable).To(HaveLen(1))
+			Expect(cfg.Features["express_pay"].Overlay).To(BeEmpty())
+			Expect(cfg.Segments["staff"].Values.Suffix).To(Equal([]string{"@example.com", "@example.org"}))
+
+			Expect(cfg.Positions["features.checkout_v2.owner"]).To(Equal(
+				Position{File: "fixtures/overlays/checkout.prod.yaml", Line: 6, Column: 5},
+			))
+			Expect(cfg.Positions["features.checkout_v2.rules.enable[0].weight"]).To(Equal(
+				Position{File: "fixtures/overlays/checkout.prod.yaml", Line: 12, Column: 11},
+			))
+			Expect(cfg.Positions["features.checkout_v2.rules.enable[1].segment"].File).To(HaveSuffix("checkout.yaml"))
+			Expect(cfg.Positions["features.checkout_v2.rules.enable[2]"]).To(Equal(
+				Position{File: "fixtures/overlays/checkout.prod.yaml", Line: 13, Column: 11},
+			))
+			Expect(cfg.Positions).NotTo(HaveKey("features.express_pay.rules.enable"))
+		})
+
+		It("replaces features with the environment's overlays", func() {
+			cfg, err := LoadDir("./fixtures/overlays", "dev", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			checkout := cfg.Features["checkout_v2"]
+			Expect(checkout.Owner).To(BeEmpty())
+			Expect(checkout.Rules.Enable).To(Equal([]EnableRule{
+				{Fields: []string{"customer_id"}, Weight: weight(100), Mode: RuleModeAnd},
+			}))
+			Expect(checkout.Rules.Disable).To(BeEmpty())
+			Expect(checkout.Sources).To(Equal([]string{"checkout.dev.toml"}))
+		})
+
+		It("loads files whose names look like overlays for undeclared environments as base files", func() {
+			cfg, err := LoadDir("./fixtures/dotted", "", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features).To(HaveKey("billing_v1"))
+			Expect(cfg.Features).To(HaveKey("billing_v2"))
+		})
+
+		It("rejects files named like overlays for declared environments that don't set one", func() {
+			for _, env := range []string{"", "prod"} {
+				_, err := LoadDir("./fixtures/unmarked_overlay", env, MergeOptIn)
+				Expect(err).To(MatchError(
+					"fixtures/unmarked_overlay/search.prod.yaml: file is named like an overlay for 'prod', " +
+						"set 'environment: prod' to make it one, or rename it",
+				))
+			}
+		})
+
+		It("warns about environments without overlays", func() {
+			cfg, err := LoadDir("./fixtures/overlays", "prd", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Warnings).To(ConsistOf(MatchError("no overlay files set 'environment: prd', so none are applied")))
+		})
+
+		It("lists the environments with overlays", func() {
+			envs, err := Environments("./fixtures/overlays")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(envs).To(Equal([]string{"dev", "prod"}))
+		})
+
+		It("doesn't resolve references in other environments' overlays", func() {
+			cfg, err := LoadDir("./fixtures/overlay_secrets", "dev", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["checkout_v2"].Rules.SetVars).To(BeEmpty())
+			envs, err := Environments("./fixtures/overlay_secrets")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(envs).To(Equal([]string{"prod"}))
+
+			_, err = LoadDir("./fixtures/overlay_secrets", "prod", MergeOptIn)
+			Expect(err).To(MatchError(ContainSubstring(
+				"checkout.prod.yaml:13:13: features.checkout_v2.rules.set_vars[0].set.api_key: read '${file:secrets/prod_api_key}'",
+			)))
+		})
+
+		It("loads without resolving references", func() {
+			cfg, err := LoadDirUnresolved("./fixtures/overlay_secrets", "prod", MergeOptIn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Features["checkout_v2"].Rules.SetVars[0].Set).To(Equal(map[string]interface{}{
+				"api_key": "${file:secrets/prod_api_key}",
+			}))
+		})
+
+		It("rejects overlay in base files", func() {
+			_, err := LoadDir("./fixtures/overlay_in_base", "prod", MergeOptIn)
+			Expect(err).To(MatchError(ContainSubstring(
+				"checkout.yaml:5:5: features.checkout_v2.overlay: only overlay files, which set environment, can set overlay",
+			)))
+		})
+	})
+
+	Describe("EncodeYAML", func() {
+		It("writes version 1 rules in the latest version", func() {
+			cfg, err := LoadYAMLDir("./fixtures/dir")
+			Expect(err).NotTo(HaveOccurred())
+			var b bytes.Buffer
+			Expect(cfg.EncodeYAML(&b)).To(Succeed())
+			encoded, err := LoadYAML(&b)
+			Expect(err).NotTo(HaveOccurred())
+			rule := encoded.Features["stripe_billing"].Rules.Enable[0]
+			Expect(rule.Fields).To(Equal([]string{"customer_id"}))
+			Expect(rule.Mode).To(Equal(RuleModeOr))
+			Expect(encoded.Features["stripe_billing"].Merge).To(BeFalse())
+			Expect(encoded.Features["stripe_billing"].Bucketing).To(Equal(BucketingLegacy))
+		})
+
+		It("writes a config that loads the same", func() {
+			for _, dir := range []string{"dir", "conditions", "segments", "metadata"} {
+				cfg, err := LoadDir(filepath.Join("./fixtures", dir), "", MergeOptIn)
+				Expect(err).NotTo(HaveOccurred())
+
+				var b bytes.Buffer
+				Expect(cfg.EncodeYAML(&b)).To(Succeed())
+				encoded, err := LoadYAML(bytes.NewReader(b.Bytes()))
+				Expect(err).NotTo(HaveOccurred(), dir)
+				Expect(encoded.Version).To(Equal("2.0"))
+
+				// encoding again changes nothing, so nothing was lost
+				var again bytes.Buffer
+				Expect(encoded.EncodeYAML(&again)).To(Succeed())
+				Expect(again.String()).To(Equal(b.String()), dir)
+			}
 		})
 	})
 })
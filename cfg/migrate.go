@@ -0,0 +1,292 @@
+package cfg
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// MigrateYAML rewrites a config file in the latest schema version. It returns
+// false if the file is already in the latest version. Errors in the file are
+// reported at their position in file.
+//
+// The changes are made to the text of the file at the positions of the nodes
+// they apply to, rather than by re-encoding it, so comments, blank lines and
+// quoting are kept as they are. References to environment variables and files
+// are left as they are too, and aren't resolved to check the file, as they
+// might only resolve where the config is deployed.
+func MigrateYAML(b []byte, file string) ([]byte, bool, error) {
+	if _, err := loadYAML(bytes.NewReader(b), file, false); err != nil {
+		return nil, false, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, false, errors.Wrap(err, "read yaml")
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return b, false, nil
+	}
+	root := doc.Content[0]
+
+	version := mapValue(root, "version")
+	v := ""
+	if version != nil {
+		v = version.Value
+	}
+	schema, err := SchemaVersion(v)
+	if err != nil {
+		return nil, false, err
+	}
+	if schema == LatestSchema {
+		return b, false, nil
+	}
+
+	m := migration{lines: strings.SplitAfter(string(b), "\n")}
+	if version == nil {
+		m.insertLine(root.Line, 0, "version: 2.0")
+	} else {
+		m.replaceScalar(version, "2.0")
+	}
+	if features := mapValue(root, "features"); features != nil && features.Kind == yaml.MappingNode {
+		for i := 1; i < len(features.Content); i += 2 {
+			m.feature(features.Content[i])
+		}
+	}
+
+	out := []byte(m.apply())
+	if _, err := loadYAML(bytes.NewReader(out), "", false); err != nil {
+		return nil, false, errors.Wrap(err, "load migrated config")
+	}
+	return out, true, nil
+}
+
+// NeedsMigration reports whether a config file in any of the supported formats
+// is in an older schema version. References in it aren't resolved.
+func NeedsMigration(r io.Reader, file string) (bool, error) {
+	c, err := loadFile(r, file, false)
+	if err != nil {
+		return false, err
+	}
+	v, err := SchemaVersion(c.Version)
+	return v < LatestSchema, err
+}
+
+// CheckMigration checks the config in a directory loads with the migrated
+// files in place of the originals, under the merge policy and with each
+// environment's overlays, so that migrating a directory doesn't leave it in a
+// state that can't be loaded, e.g. with features that merge across files in
+// different versions. migrated maps the paths of the files, as Files returns
+// them, to their migrated contents. References aren't resolved.
+func CheckMigration(filePath, merge string, migrated map[string][]byte) error {
+	envs, err := Environments(filePath)
+	if err != nil {
+		return err
+	}
+	for _, env := range append([]string{""}, envs...) {
+		if _, err := loadDir(filePath, env, merge, false, migrated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migration collects the edits that rewrite a version 1 file as version 2.
+type migration struct {
+	lines []string
+	edits []edit
+}
+
+// edit replaces n bytes at col on line (both 1-based) with text. Edits with
+// newLine set insert text as a new line before line instead.
+type edit struct {
+	line, col, n int
+	text         string
+	newLine      bool
+}
+
+func (m *migration) replace(line, col, n int, text string) {
+	m.edits = append(m.edits, edit{line: line, col: col, n: n, text: text})
+}
+
+func (m *migration) insertLine(line, indent int, text string) {
+	m.edits = append(m.edits, edit{line: line, text: strings.Repeat(" ", indent) + text, newLine: true})
+}
+
+// replaceScalar replaces the value of a scalar, keeping its quotes.
+func (m *migration) replaceScalar(n *yaml.Node, value string) {
+	col := n.Column
+	if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		col++
+	}
+	m.replace(n.Line, col, len(n.Value), value)
+}
+
+func (m *migration) feature(feature *yaml.Node) {
+	if feature.Kind != yaml.MappingNode {
+		return
+	}
+	m.bucketing(feature)
+	if variants := mapValue(feature, "variants"); variants != nil && variants.Kind == yaml.MappingNode {
+		m.field(variants)
+	}
+	rules := mapValue(feature, "rules")
+	if rules == nil || rules.Kind != yaml.MappingNode {
+		return
+	}
+	for _, kind := range []string{"enable", "disable", "set_vars"} {
+		list := mapValue(rules, kind)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, rule := range list.Content {
+			if rule.Kind != yaml.MappingNode {
+				continue
+			}
+			m.field(rule)
+			if kind != "disable" {
+				m.mode(rule)
+			}
+		}
+	}
+}
+
+// field replaces 'field: x' with 'fields: [x]'.
+func (m *migration) field(n *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Value != "field" || value.Kind != yaml.ScalarNode {
+			continue
+		}
+		m.replace(key.Line, key.Column, len("field"), "fields")
+		m.replace(value.Line, value.Column, 0, "[")
+		m.replace(value.Line, value.Column+m.scalarLen(value), 0, "]")
+		return
+	}
+}
+
+// scalarLen returns the length of a single line scalar as it's written.
+func (m *migration) scalarLen(n *yaml.Node) int {
+	text := m.lines[n.Line-1][n.Column-1:]
+	switch n.Style {
+	case yaml.DoubleQuotedStyle:
+		for i := 1; i < len(text); i++ {
+			switch text[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+	case yaml.SingleQuotedStyle:
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				continue
+			}
+			if i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(n.Value)
+}
+
+// bucketing sets 'bucketing: legacy' on features that don't have a bucketing,
+// as that was the default. It only matters to features with weighted rules or
+// variants, but setting it on every feature keeps the users a rollout selects
+// the same if one is added later. Features with a salt already use salted
+// bucketing, which is the default in version 2.
+func (m *migration) bucketing(feature *yaml.Node) {
+	if mapValue(feature, "bucketing") != nil || mapValue(feature, "salt") != nil || len(feature.Content) == 0 {
+		return
+	}
+	key := feature.Content[0]
+	if feature.Style&yaml.FlowStyle != 0 {
+		m.replace(key.Line, key.Column, 0, "bucketing: legacy, ")
+		return
+	}
+	m.insertLine(key.Line, key.Column-1, "bucketing: legacy")
+}
+
+// mode sets 'mode: or' on rules that don't have a mode, as that was the
+// default. Only rules with both a weight and values or conditions behave
+// differently in 'and' mode, but setting it on every rule keeps the meaning
+// of the file obvious, and of rules that are edited later the same.
+func (m *migration) mode(rule *yaml.Node) {
+	if mapValue(rule, "mode") != nil || len(rule.Content) == 0 {
+		return
+	}
+
+	// put the mode next to the weight or ramp it applies to
+	at := -1
+	for i := 0; i+1 < len(rule.Content); i += 2 {
+		if k := rule.Content[i].Value; k == "weight" || k == "ramp" {
+			at = i
+			break
+		}
+	}
+	if rule.Style&yaml.FlowStyle != 0 {
+		if at < 0 {
+			at = 0
+		}
+		key := rule.Content[at]
+		m.replace(key.Line, key.Column, 0, `mode: "or", `)
+		return
+	}
+	if at <= 0 {
+		if len(rule.Content) == 2 {
+			// the only key shares its line with the '- ' of the list
+			// item, so the mode goes on that line and the key on the next
+			key := rule.Content[0]
+			m.replace(key.Line, key.Column, 0, "mode: \"or\"\n"+strings.Repeat(" ", key.Column-1))
+			return
+		}
+		// the first key shares its line with the '- ' of the list item
+		at = 2
+	}
+	key := rule.Content[at]
+	m.insertLine(key.Line, key.Column-1, `mode: "or"`)
+}
+
+// apply returns the text of the file with the edits made.
+func (m *migration) apply() string {
+	// edits are made from the end of the file backwards, so the positions
+	// of the ones still to be made don't move
+	sort.SliceStable(m.edits, func(i, j int) bool {
+		a, b := m.edits[i], m.edits[j]
+		if a.line != b.line {
+			return a.line > b.line
+		}
+		if a.newLine != b.newLine {
+			return !a.newLine
+		}
+		return a.col > b.col
+	})
+	lines := m.lines
+	for _, e := range m.edits {
+		i := e.line - 1
+		if e.newLine {
+			lines = append(lines[:i], append([]string{e.text + "\n"}, lines[i:]...)...)
+			continue
+		}
+		l := lines[i]
+		lines[i] = l[:e.col-1] + e.text + l[e.col-1+e.n:]
+	}
+	return strings.Join(lines, "")
+}
+
+// mapValue returns the value of key in the mapping node n, or nil.
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
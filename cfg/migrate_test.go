@@ -0,0 +1,47 @@
+package cfg_test
+
+import (
+	"io/ioutil"
+
+	. "github.com/dylannz/feature-service/cfg"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MigrateYAML", func() {
+	It("rewrites version 1 files as version 2, keeping comments and formatting", func() {
+		v1, err := ioutil.ReadFile("./fixtures/migrate/v1.yml")
+		Expect(err).NotTo(HaveOccurred())
+		v2, err := ioutil.ReadFile("./fixtures/migrate/v2.yml")
+		Expect(err).NotTo(HaveOccurred())
+
+		migrated, changed, err := MigrateYAML(v1, "v1.yml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(string(migrated)).To(Equal(string(v2)))
+	})
+
+	It("leaves files in the latest version alone", func() {
+		v2, err := ioutil.ReadFile("./fixtures/migrate/v2.yml")
+		Expect(err).NotTo(HaveOccurred())
+
+		migrated, changed, err := MigrateYAML(v2, "v2.yml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(migrated).To(Equal(v2))
+	})
+
+	It("doesn't resolve references to environment variables and files", func() {
+		v1 := []byte("features:\n  a:\n    rules:\n      set_vars:\n        - field: \"customer_id\"\n" +
+			"          set:\n            key: ${file:key.txt}\n            host: ${FS_TEST_UNSET}\n")
+		migrated, changed, err := MigrateYAML(v1, "v1.yml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(string(migrated)).To(ContainSubstring("key: ${file:key.txt}\n            host: ${FS_TEST_UNSET}\n"))
+	})
+
+	It("refuses to migrate invalid files", func() {
+		_, _, err := MigrateYAML([]byte("version: 1.0\nfeatures:\n  a:\n    rules:\n      enable:\n        - weigth: 5\n"), "bad.yml")
+		Expect(err).To(MatchError("bad.yml:6:11: features.a.rules.enable[0]: field weigth not found in type cfg.EnableRule"))
+	})
+})
@@ -0,0 +1,171 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Overlay modes, for Feature.Overlay.
+const (
+	// OverlayPatch changes what the overlay sets and keeps the rest of the
+	// base feature. It's the default.
+	OverlayPatch = "patch"
+	// OverlayReplace replaces the base feature with the overlay's.
+	OverlayReplace = "replace"
+)
+
+// ApplyOverlay applies the config from an environment's overlay file to c, the
+// base config. Unlike Append, an overlay changes what's already defined:
+//
+//   - features with overlay 'replace' replace the base feature entirely
+//   - features with overlay 'patch', the default, replace the base feature's
+//     settings they set, and its enable and disable rules with the same id as
+//     one of theirs; their other rules are added after the base feature's
+//   - segments replace the base segment with the same name
+//
+// Features and segments the base config doesn't define are added.
+func (c *Config) ApplyOverlay(o Config) {
+	if c.Features == nil {
+		c.Features = map[string]Feature{}
+	}
+	if c.Positions == nil {
+		c.Positions = Positions{}
+	}
+	for name, feature := range o.Features {
+		path := "features." + name
+		f, ok := c.Features[name]
+		if !ok || feature.Overlay == OverlayReplace {
+			feature.Overlay = ""
+			c.Features[name] = feature
+			c.replacePositions(o.Positions, path, path)
+			continue
+		}
+		c.Features[name] = c.patch(path, f, feature, o.Positions)
+	}
+
+	if c.Segments == nil && len(o.Segments) > 0 {
+		c.Segments = map[string]Condition{}
+	}
+	for name, segment := range o.Segments {
+		c.Segments[name] = segment
+		path := "segments." + name
+		c.replacePositions(o.Positions, path, path)
+	}
+	c.Warnings = append(c.Warnings, o.Warnings...)
+}
+
+// patch returns feature f at path in c patched by the overlay feature o,
+// whose positions are in positions.
+func (c *Config) patch(path string, f, o Feature, positions Positions) Feature {
+	if o.StartAt != nil {
+		f.StartAt = o.StartAt
+	}
+	if o.EndAt != nil {
+		f.EndAt = o.EndAt
+	}
+	if o.Schedule != nil {
+		f.Schedule = o.Schedule
+	}
+	if o.Salt != "" {
+		f.Salt = o.Salt
+	}
+	// version 2 overlays default to salted bucketing, so only change it if
+	// the overlay sets it
+	if _, ok := positions[path+".bucketing"]; ok {
+		f.Bucketing = o.Bucketing
+	}
+	if o.Description != "" {
+		f.Description = o.Description
+	}
+	if o.Owner != "" {
+		f.Owner = o.Owner
+	}
+	if len(o.Tags) > 0 {
+		f.Tags = o.Tags
+	}
+	if o.CreatedAt != nil {
+		f.CreatedAt = o.CreatedAt
+	}
+	if o.ExpiresAt != nil {
+		f.ExpiresAt = o.ExpiresAt
+	}
+	if len(o.Requires) > 0 {
+		f.Requires = o.Requires
+	}
+	if o.Variants.Field != "" || len(o.Variants.Fields) > 0 || len(o.Variants.Allocation) > 0 {
+		f.Variants = o.Variants
+	}
+	// the settings the overlay sets are the keys directly under the feature
+	for k := range positions {
+		if !strings.HasPrefix(k, path+".") {
+			continue
+		}
+		key := k[len(path)+1:]
+		if strings.ContainsAny(key, ".[") || key == "rules" || key == "overlay" || key == "merge" {
+			continue
+		}
+		c.replacePositions(positions, k, k)
+	}
+
+	// the base feature's rules are copied so patching them doesn't change
+	// the base config they came from
+	enable := append([]EnableRule(nil), f.Rules.Enable...)
+	for i, rule := range o.Rules.Enable {
+		j := len(enable)
+		for k, r := range enable {
+			if rule.ID != "" && r.ID == rule.ID {
+				j = k
+			}
+		}
+		if j == len(enable) {
+			enable = append(enable, rule)
+		} else {
+			enable[j] = rule
+		}
+		c.moveRule(positions, path+".rules.enable", i, j)
+	}
+	disable := append([]DisableRule(nil), f.Rules.Disable...)
+	for i, rule := range o.Rules.Disable {
+		j := len(disable)
+		for k, r := range disable {
+			if rule.ID != "" && r.ID == rule.ID {
+				j = k
+			}
+		}
+		if j == len(disable) {
+			disable = append(disable, rule)
+		} else {
+			disable[j] = rule
+		}
+		c.moveRule(positions, path+".rules.disable", i, j)
+	}
+	setVars := append([]SetVarRule(nil), f.Rules.SetVars...)
+	for i, rule := range o.Rules.SetVars {
+		c.moveRule(positions, path+".rules.set_vars", i, len(setVars))
+		setVars = append(setVars, rule)
+	}
+	f.Rules = Rules{Enable: enable, Disable: disable, SetVars: setVars}
+	for _, k := range []string{".rules", ".rules.enable", ".rules.disable", ".rules.set_vars"} {
+		if _, ok := c.Positions[path+k]; !ok {
+			if pos, ok := positions[path+k]; ok {
+				c.Positions[path+k] = pos
+			}
+		}
+	}
+
+	f.Sources = append(append([]string(nil), f.Sources...), o.Sources...)
+	return f
+}
+
+// moveRule sets the positions of rule j in the list at path to those of the
+// overlay's rule i.
+func (c *Config) moveRule(positions Positions, path string, i, j int) {
+	c.replacePositions(positions, fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("%s[%d]", path, j))
+}
+
+// replacePositions replaces the positions at and under to with the positions
+// at and under from in p.
+func (c *Config) replacePositions(p Positions, from, to string) {
+	c.Positions = c.Positions.remove(to)
+	c.Positions.add(p.under(from).move(from, to))
+}
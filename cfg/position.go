@@ -0,0 +1,234 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Position is where something is defined in a config file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	s := p.File
+	if p.Line > 0 {
+		if s != "" {
+			s += ":"
+		}
+		s += strconv.Itoa(p.Line)
+		if p.Column > 0 {
+			s += ":" + strconv.Itoa(p.Column)
+		}
+	}
+	return s
+}
+
+// Positions maps paths in the config, in the same form as they appear in
+// error messages (e.g. 'features.x.rules.enable[0].values'), to where they're
+// defined.
+type Positions map[string]Position
+
+// Lookup returns the position of path, or of the closest enclosing path that
+// has one.
+func (p Positions) Lookup(path string) (Position, bool) {
+	for path != "" {
+		if pos, ok := p[path]; ok {
+			return pos, true
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return Position{}, false
+}
+
+// atLine returns the outermost path defined on a line, for errors that only
+// have a line number.
+func (p Positions) atLine(line int) (string, Position, bool) {
+	var path string
+	var pos Position
+	for k, v := range p {
+		if v.Line != line {
+			continue
+		}
+		if path == "" || v.Column < pos.Column || (v.Column == pos.Column && len(k) < len(path)) {
+			path, pos = k, v
+		}
+	}
+	return path, pos, path != ""
+}
+
+// shift renumbers the positions of the items in the list at prefix by offset,
+// for when the list is appended to another.
+func (p Positions) shift(prefix string, offset int) Positions {
+	if offset == 0 {
+		return p
+	}
+	shifted := Positions{}
+	for k, v := range p {
+		if strings.HasPrefix(k, prefix+"[") {
+			rest := k[len(prefix)+1:]
+			if end := strings.Index(rest, "]"); end >= 0 {
+				if i, err := strconv.Atoi(rest[:end]); err == nil {
+					k = fmt.Sprintf("%s[%d]%s", prefix, i+offset, rest[end+1:])
+				}
+			}
+		}
+		shifted[k] = v
+	}
+	return shifted
+}
+
+// move moves the positions at and under from to be under to instead.
+func (p Positions) move(from, to string) Positions {
+	moved := Positions{}
+	for k, v := range p {
+		if within(k, from) {
+			k = to + k[len(from):]
+		}
+		moved[k] = v
+	}
+	return moved
+}
+
+// under returns the positions at and under path.
+func (p Positions) under(path string) Positions {
+	u := Positions{}
+	for k, v := range p {
+		if within(k, path) {
+			u[k] = v
+		}
+	}
+	return u
+}
+
+// remove returns the positions that aren't at or under path.
+func (p Positions) remove(path string) Positions {
+	r := Positions{}
+	for k, v := range p {
+		if !within(k, path) {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// within reports whether k is path or a path under it.
+func within(k, path string) bool {
+	return k == path || strings.HasPrefix(k, path+".") || strings.HasPrefix(k, path+"[")
+}
+
+// add adds the positions in a that aren't in p already.
+func (p Positions) add(a Positions) {
+	for k, v := range a {
+		if _, ok := p[k]; !ok {
+			p[k] = v
+		}
+	}
+}
+
+// addNode adds the positions of node and everything in it, with node at path.
+// The positions of map values are the positions of their keys, which is where
+// an editor would point.
+func (p Positions) addNode(file, path string, node *yaml.Node, pos Position) {
+	if path != "" {
+		p[path] = pos
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			p.addNode(file, path, n, pos)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				// merge keys add the values of another map to this one
+				p.addNode(file, path, value, pos)
+				continue
+			}
+			keyPath := key.Value
+			if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			p.addNode(file, keyPath, value, Position{File: file, Line: key.Line, Column: key.Column})
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			p.addNode(file, fmt.Sprintf("%s[%d]", path, i), n, Position{File: file, Line: n.Line, Column: n.Column})
+		}
+	case yaml.AliasNode:
+		if node.Alias != nil && node.Alias.Kind != yaml.AliasNode {
+			p.addNode(file, path, node.Alias, pos)
+		}
+	}
+}
+
+// PositionError is an error in a config file, with where it is.
+type PositionError struct {
+	Position Position
+	Err      error
+}
+
+func (e PositionError) Error() string {
+	if s := e.Position.String(); s != "" {
+		return s + ": " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e PositionError) Cause() error  { return e.Err }
+func (e PositionError) Unwrap() error { return e.Err }
+
+// pathRegexp matches the path at the start of validation errors.
+var pathRegexp = regexp.MustCompile(`^(?:version|(?:features|segments)\.[^:\s]+)`)
+
+// positionError adds the position of the path at the start of err's message,
+// if it has one.
+func (p Positions) positionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	pos, ok := p.Lookup(pathRegexp.FindString(err.Error()))
+	if !ok {
+		return err
+	}
+	return PositionError{Position: pos, Err: err}
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError turns an error decoding a file into a PositionError. The yaml
+// package only reports line numbers, so the path at that line is found from
+// text, the positions of the decoded YAML, and the position reported is the
+// path's position in source.
+func yamlError(file string, err error, text, source Positions) error {
+	msg := err.Error()
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) > 0 {
+		// report the first error, as validation does
+		msg = typeErr.Errors[0]
+	}
+	m := yamlLineRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return PositionError{Position: Position{File: file}, Err: err}
+	}
+	line, _ := strconv.Atoi(m[1])
+	if path, _, ok := text.atLine(line); ok {
+		pos, ok := source.Lookup(path)
+		if !ok {
+			pos = Position{File: file}
+		}
+		return PositionError{Position: pos, Err: errors.Errorf("%s: %s", path, m[2])}
+	}
+	return PositionError{Position: Position{File: file, Line: line}, Err: errors.New(m[2])}
+}
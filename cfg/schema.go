@@ -0,0 +1,98 @@
+package cfg
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// The schema versions config files can use. Each file is decoded according to
+// its own version, so files with different versions can be loaded together.
+//
+// Version 2 changes rules so that:
+//   - mode defaults to 'and', so a rule's weight applies to the users its
+//     values and conditions match, instead of to everyone
+//   - field is replaced by fields, which is always a list
+//
+// and features so that bucketing defaults to 'salted' instead of 'legacy'.
+const (
+	SchemaV1     = 1
+	SchemaV2     = 2
+	LatestSchema = SchemaV2
+)
+
+// SchemaVersion returns the schema version of a config's version string.
+// Files without a version are version 1, as the version was optional before
+// there was more than one.
+func SchemaVersion(version string) (int, error) {
+	switch version {
+	case "", "1", "1.0":
+		return SchemaV1, nil
+	case "2", "2.0":
+		return SchemaV2, nil
+	}
+	return 0, errors.Errorf("version: unknown version '%s', must be '1.0' or '2.0'", version)
+}
+
+// upgrade converts a config decoded with its version's schema to the latest
+// one, which is what the service uses.
+func (c *Config) upgrade() error {
+	v, err := SchemaVersion(c.Version)
+	if err != nil {
+		return err
+	}
+	if v == SchemaV1 {
+		// version 2 only adds defaults and removes ways of writing things,
+		// but a salt is only used by salted bucketing, so setting one opts
+		// in to it
+		for _, name := range c.featureNames() {
+			feature := c.Features[name]
+			if feature.Salt != "" && feature.Bucketing == "" {
+				feature.Bucketing = BucketingSalted
+				prefix := "features." + name
+				c.Positions[prefix+".bucketing"] = c.Positions[prefix+".salt"]
+				c.Features[name] = feature
+			}
+		}
+		return nil
+	}
+
+	for _, name := range c.featureNames() {
+		feature := c.Features[name]
+		if feature.Bucketing == "" {
+			feature.Bucketing = BucketingSalted
+		}
+		if feature.Variants.Field != "" {
+			return errors.Errorf("features.%s.variants.field: use fields in version 2.0", name)
+		}
+		for i := range feature.Rules.Enable {
+			rule := &feature.Rules.Enable[i]
+			if err := upgradeRule(fmt.Sprintf("features.%s.rules.enable[%d]", name, i), rule.Field, &rule.Mode); err != nil {
+				return err
+			}
+		}
+		for i, rule := range feature.Rules.Disable {
+			if rule.Field != "" {
+				return errors.Errorf("features.%s.rules.disable[%d].field: use fields in version 2.0", name, i)
+			}
+		}
+		for i := range feature.Rules.SetVars {
+			rule := &feature.Rules.SetVars[i]
+			if err := upgradeRule(fmt.Sprintf("features.%s.rules.set_vars[%d]", name, i), rule.Field, &rule.Mode); err != nil {
+				return err
+			}
+		}
+		c.Features[name] = feature
+	}
+	return nil
+}
+
+func upgradeRule(path, field string, mode *string) error {
+	if field != "" {
+		return errors.Errorf("%s.field: use fields in version 2.0", path)
+	}
+	if *mode == "" {
+		*mode = RuleModeAnd
+	}
+	return nil
+}
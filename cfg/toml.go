@@ -0,0 +1,165 @@
+package cfg
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// loadTOML loads a TOML config file. It's converted to YAML so that it's
+// decoded and validated in exactly the same way as YAML files, with errors
+// reported at the positions in the TOML. References in values are resolved if
+// resolve is set.
+func loadTOML(r io.Reader, file string, resolve bool) (Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "read toml")}
+	}
+
+	var v map[string]interface{}
+	if err := toml.Unmarshal(b, &v); err != nil {
+		var decodeErr *toml.DecodeError
+		if errors.As(err, &decodeErr) {
+			line, col := decodeErr.Position()
+			return Config{}, PositionError{Position: Position{File: file, Line: line, Column: col}, Err: err}
+		}
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "read toml")}
+	}
+	source, err := tomlPositions(b, file)
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "read toml")}
+	}
+
+	y, err := convertedYAML(tomlToYAML(v))
+	if err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "convert toml")}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(y, &doc); err != nil {
+		return Config{}, PositionError{Position: Position{File: file}, Err: errors.Wrap(err, "convert toml")}
+	}
+	positions := Positions{}
+	positions.addNode(file, "", &doc, Position{File: file})
+	return decodeConfig(y, file, positions, source, b, resolve)
+}
+
+// tomlToYAML converts the values TOML decodes to that YAML can't represent.
+// Local dates and times don't have a time zone, so they become strings and
+// are rejected when decoded into a time, as they would be in YAML.
+func tomlToYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = tomlToYAML(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = tomlToYAML(e)
+		}
+	case toml.LocalDate, toml.LocalTime, toml.LocalDateTime:
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// tomlPositions returns the positions of everything in a TOML file, with the
+// same paths as the YAML it's converted to.
+func tomlPositions(b []byte, file string) (Positions, error) {
+	t := tomlPositionParser{positions: Positions{}, arrays: map[string]int{}, file: file}
+	t.parser.Reset(b)
+	for t.parser.NextExpression() {
+		expr := t.parser.Expression()
+		switch expr.Kind {
+		case unstable.Table:
+			t.table = t.path("", expr.Key(), false)
+		case unstable.ArrayTable:
+			// each [[table]] adds an item to the list
+			path := t.path("", expr.Key(), true)
+			i := t.arrays[path]
+			t.arrays[path]++
+			t.table = fmt.Sprintf("%s[%d]", path, i)
+			key := expr.Key()
+			for key.Next() {
+				t.positions[t.table] = t.position(key.Node())
+			}
+		case unstable.KeyValue:
+			t.keyValue(t.table, expr)
+		}
+	}
+	return t.positions, t.parser.Error()
+}
+
+type tomlPositionParser struct {
+	parser    unstable.Parser
+	positions Positions
+	file      string
+
+	// table is the path of the table key/values are added to
+	table string
+	// arrays counts the items added to each array of tables so far
+	arrays map[string]int
+}
+
+// path returns the path of a (possibly dotted) key in the table at base,
+// adding the position of each part that doesn't have one yet. Keys that refer
+// to an array of tables refer to its last item, unless it's the last part of
+// an array table's key, which adds a new item.
+func (t *tomlPositionParser) path(base string, key unstable.Iterator, arrayTable bool) string {
+	path := base
+	for key.Next() {
+		k := key.Node()
+		if path == "" {
+			path = string(k.Data)
+		} else {
+			path += "." + string(k.Data)
+		}
+		if _, ok := t.positions[path]; !ok {
+			t.positions[path] = t.position(k)
+		}
+		if n, ok := t.arrays[path]; ok && !(arrayTable && key.IsLast()) {
+			path = fmt.Sprintf("%s[%d]", path, n-1)
+		}
+	}
+	return path
+}
+
+func (t *tomlPositionParser) keyValue(table string, kv *unstable.Node) {
+	path := t.path(table, kv.Key(), false)
+	t.value(path, kv.Value())
+}
+
+func (t *tomlPositionParser) value(path string, v *unstable.Node) {
+	switch v.Kind {
+	case unstable.InlineTable:
+		children := v.Children()
+		for children.Next() {
+			t.keyValue(path, children.Node())
+		}
+	case unstable.Array:
+		children := v.Children()
+		for i := 0; children.Next(); i++ {
+			item := fmt.Sprintf("%s[%d]", path, i)
+			if pos := t.position(children.Node()); pos.Line > 0 {
+				t.positions[item] = pos
+			} else {
+				t.positions[item] = t.positions[path]
+			}
+			t.value(item, children.Node())
+		}
+	}
+}
+
+// position returns the position of a node, which only has one if it refers
+// to part of the file.
+func (t *tomlPositionParser) position(n *unstable.Node) Position {
+	if n.Raw.Length == 0 {
+		return Position{File: t.file}
+	}
+	start := t.parser.Shape(n.Raw).Start
+	return Position{File: t.file, Line: start.Line, Column: start.Column}
+}
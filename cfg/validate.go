@@ -0,0 +1,407 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dylannz/feature-service/semver"
+	"github.com/pkg/errors"
+)
+
+// Validate checks the config for mistakes that can't be caught while decoding
+// it, such as invalid regular expressions.
+func (c Config) Validate() error {
+	err := c.eachWindow(validateWindow)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range c.featureNames() {
+		feature := c.Features[name]
+		if feature.Overlay != "" && c.Environment == "" {
+			return errors.Errorf("features.%s.overlay: only overlay files, which set environment, can set overlay", name)
+		}
+		if err := validateOverlay(feature.Overlay); err != nil {
+			return errors.Wrapf(err, "features.%s.overlay", name)
+		}
+		if err := validateBucketing(feature.Bucketing); err != nil {
+			return errors.Wrapf(err, "features.%s.bucketing", name)
+		}
+		if feature.Salt != "" && feature.Bucketing == BucketingLegacy {
+			return errors.Errorf("features.%s.salt: salt is only used with 'bucketing: %s'", name, BucketingSalted)
+		}
+		if err := validateFields(feature.Variants.Field, feature.Variants.Fields); err != nil {
+			return errors.Wrapf(err, "features.%s.variants", name)
+		}
+		for i, v := range feature.Variants.Allocation {
+			if v.Weight < 0 {
+				return errors.Errorf("features.%s.variants.allocation[%d].weight: weight (%d) can't be negative", name, i, v.Weight)
+			}
+			if hasVariant(Variants{Allocation: feature.Variants.Allocation[:i]}, v.Name) {
+				return errors.Errorf("features.%s.variants.allocation[%d].name: duplicate variant '%s'", name, i, v.Name)
+			}
+		}
+		for i, rule := range feature.Rules.Enable {
+			path := fmt.Sprintf("features.%s.rules.enable[%d]", name, i)
+			if err := validateMode(rule.Mode); err != nil {
+				return errors.Wrapf(err, "%s.mode", path)
+			}
+			weighted := rule.WeightOrZero() != 0 || rule.Ramp != nil
+			if err := validateRule(rule.Field, rule.Fields, rule.Values, rule.Conditions, weighted); err != nil {
+				return errors.Wrap(err, path)
+			}
+			if rule.Mode == RuleModeAnd {
+				if err := validateAndRule(rule.Values, rule.Conditions, rule.Weight != nil || rule.Ramp != nil); err != nil {
+					return errors.Wrap(err, path)
+				}
+			}
+			if err := validateWeight(rule.WeightOrZero()); err != nil {
+				return errors.Wrapf(err, "%s.weight", path)
+			}
+			if rule.Ramp == nil {
+				continue
+			}
+			if err := validateRamp(*rule.Ramp); err != nil {
+				return errors.Wrapf(err, "%s.ramp", path)
+			}
+		}
+		for i, rule := range feature.Rules.Disable {
+			path := fmt.Sprintf("features.%s.rules.disable[%d]", name, i)
+			if err := validateRule(rule.Field, rule.Fields, rule.Values, rule.Conditions, false); err != nil {
+				return errors.Wrap(err, path)
+			}
+		}
+		for i, rule := range feature.Rules.SetVars {
+			path := fmt.Sprintf("features.%s.rules.set_vars[%d]", name, i)
+			if err := validateMode(rule.Mode); err != nil {
+				return errors.Wrapf(err, "%s.mode", path)
+			}
+			if err := validateRule(rule.Field, rule.Fields, rule.Values, rule.Conditions, rule.WeightOrZero() != 0); err != nil {
+				return errors.Wrap(err, path)
+			}
+			if rule.Mode == RuleModeAnd {
+				if err := validateAndRule(rule.Values, rule.Conditions, rule.Weight != nil); err != nil {
+					return errors.Wrap(err, path)
+				}
+			}
+			if err := validateWeight(rule.WeightOrZero()); err != nil {
+				return errors.Wrapf(err, "%s.weight", path)
+			}
+			if len(rule.Set) == 0 {
+				return errors.Errorf("%s.set: no vars to set", path)
+			}
+		}
+	}
+
+	for _, name := range c.segmentNames() {
+		segment := c.Segments[name]
+		if err := validateCondition(segment); err != nil {
+			return errors.Wrapf(err, "segments.%s", name)
+		}
+		err := eachConditions("segments."+name, segment.Values, segment.Conditions, func(path string, values MatchValues, conds Conditions) error {
+			if conds.Segment != "" {
+				return errors.Errorf("%s.segment: segments can't refer to other segments", path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.EachConditions(func(path string, values MatchValues, conds Conditions) error {
+		for i, cond := range conds.All {
+			if err := validateCondition(cond); err != nil {
+				return errors.Wrapf(err, "%s.all[%d]", path, i)
+			}
+		}
+		for i, cond := range conds.Any {
+			if err := validateCondition(cond); err != nil {
+				return errors.Wrapf(err, "%s.any[%d]", path, i)
+			}
+		}
+		if conds.Not != nil {
+			return errors.Wrapf(validateCondition(*conds.Not), "%s.not", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.EachMatchValues(func(path string, m MatchValues) error {
+		for _, r := range m.Regex {
+			if _, err := regexp.Compile(m.RegexPattern(r)); err != nil {
+				return errors.Wrapf(err, "%s.regex", path)
+			}
+		}
+		if len(m.Between) > 0 && (len(m.Between) != 2 || m.Between[0] > m.Between[1]) {
+			return errors.Errorf("%s.between: must be [min, max]", path)
+		}
+		return errors.Wrapf(validateSemver(m.Semver), "%s.semver", path)
+	})
+}
+
+func validateSemver(m SemverMatch) error {
+	for _, s := range []string{m.Eq, m.Gt, m.Gte, m.Lt, m.Lte} {
+		if s == "" {
+			continue
+		}
+		if _, err := semver.Parse(s); err != nil {
+			return err
+		}
+	}
+	if len(m.Between) == 0 {
+		return nil
+	}
+	if len(m.Between) != 2 {
+		return errors.New("between: must be [min, max]")
+	}
+	min, err := semver.Parse(m.Between[0])
+	if err != nil {
+		return errors.Wrap(err, "between")
+	}
+	max, err := semver.Parse(m.Between[1])
+	if err != nil {
+		return errors.Wrap(err, "between")
+	}
+	if semver.Compare(min, max) > 0 {
+		return errors.New("between: must be [min, max]")
+	}
+	return nil
+}
+
+func validateWindow(path string, w Window) error {
+	if w.StartAt != nil && w.EndAt != nil && !w.StartAt.Before(*w.EndAt) {
+		return errors.Errorf("%s: start_at must be before end_at", path)
+	}
+	if w.Schedule == nil {
+		return nil
+	}
+
+	for _, day := range w.Schedule.Days {
+		if _, err := ParseWeekday(day); err != nil {
+			return errors.Wrapf(err, "%s.schedule.days", path)
+		}
+	}
+	for _, t := range []string{w.Schedule.StartTime, w.Schedule.EndTime} {
+		if t == "" {
+			continue
+		}
+		if _, err := ParseTimeOfDay(t); err != nil {
+			return errors.Wrapf(err, "%s.schedule", path)
+		}
+	}
+	if w.Schedule.TimeZone != "" {
+		if _, err := time.LoadLocation(w.Schedule.TimeZone); err != nil {
+			return errors.Wrapf(err, "%s.schedule.time_zone", path)
+		}
+	}
+	return nil
+}
+
+// ValidateRefs checks that every segment and prerequisite feature the config
+// refers to is defined in all, which is the config merged from every file.
+// Segments and features can be defined in a different file to the rules that
+// refer to them, so this is checked once all of the files are loaded.
+func (c Config) ValidateRefs(all Config) error {
+	for _, name := range c.featureNames() {
+		for i, req := range c.Features[name].Requires {
+			path := fmt.Sprintf("features.%s.requires[%d]", name, i)
+			feature, ok := all.Features[req.Feature]
+			if !ok {
+				return errors.Errorf("%s: undefined feature '%s'", path, req.Feature)
+			}
+			if req.Variant != "" && !hasVariant(feature.Variants, req.Variant) {
+				return errors.Errorf("%s: feature '%s' has no variant '%s'", path, req.Feature, req.Variant)
+			}
+		}
+	}
+
+	return c.EachConditions(func(path string, values MatchValues, conds Conditions) error {
+		if _, ok := all.Segments[conds.Segment]; conds.Segment != "" && !ok {
+			return errors.Errorf("%s.segment: undefined segment '%s'", path, conds.Segment)
+		}
+		return nil
+	})
+}
+
+// validateVariants checks that the variants enable rules force are defined,
+// and that there are fields to pick a variant with for the rules that don't
+// force one. It's checked once the config is merged, as a feature's variants
+// can be defined in a different file to its rules.
+func (c Config) validateVariants() error {
+	for _, name := range c.featureNames() {
+		feature := c.Features[name]
+		hasFields := feature.Variants.Field != "" || len(feature.Variants.Fields) > 0
+		for i, rule := range feature.Rules.Enable {
+			path := fmt.Sprintf("features.%s.rules.enable[%d]", name, i)
+			if rule.Variant != "" && !hasVariant(feature.Variants, rule.Variant) {
+				return errors.Errorf("%s.variant: feature '%s' has no variant '%s'", path, name, rule.Variant)
+			}
+			// without any fields every user would get the same variant
+			if rule.Variant == "" && len(feature.Variants.Allocation) > 0 && !hasFields && rule.Field == "" && len(rule.Fields) == 0 {
+				return errors.Errorf("%s: rule has no fields to pick a variant with, set variants.fields", path)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRequires checks that no feature requires itself, directly or
+// through other features.
+func (c Config) validateRequires() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(path []string) error
+	visit = func(path []string) error {
+		name := path[len(path)-1]
+		switch state[name] {
+		case visiting:
+			// report only the part of the path that is the cycle
+			for path[0] != name {
+				path = path[1:]
+			}
+			return errors.Errorf("features.%s.requires: cycle: %s", name, strings.Join(path, " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, req := range c.Features[name].Requires {
+			if err := visit(append(path[:len(path):len(path)], req.Feature)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range c.featureNames() {
+		if err := visit([]string{name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasVariant(variants Variants, name string) bool {
+	for _, v := range variants.Allocation {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateCondition(c Condition) error {
+	switch {
+	case c.Field == "" && !c.Values.IsZero():
+		return errors.New("values need a field to match")
+	case c.Field != "" && c.Values.IsZero():
+		return errors.New("field needs values to match")
+	case c.Field == "" && c.Conditions.IsZero():
+		return errors.New("condition is empty")
+	}
+	return nil
+}
+
+// validateRule checks a rule has the fields its values and weight need. Rules
+// that only have conditions don't need fields, as conditions name their own.
+func validateRule(field string, fields []string, values MatchValues, conds Conditions, weighted bool) error {
+	if err := validateFields(field, fields); err != nil {
+		return err
+	}
+	hasFields := field != "" || len(fields) > 0
+	switch {
+	case hasFields:
+		return nil
+	case !values.IsZero():
+		return errors.New("values need a field or fields to match")
+	case weighted:
+		return errors.New("weight needs a field or fields to hash")
+	case conds.IsZero():
+		return errors.New("rule needs a field or fields")
+	}
+	return nil
+}
+
+// validateAndRule checks a rule in 'and' mode targets someone. Without values,
+// conditions or a weight it would match everyone, which is more likely a
+// forgotten weight than a feature meant to be on for all users.
+func validateAndRule(values MatchValues, conds Conditions, weighted bool) error {
+	if values.IsZero() && conds.IsZero() && !weighted {
+		return errors.New("rule in 'and' mode needs values, conditions, a weight or a ramp, or it matches everyone")
+	}
+	return nil
+}
+
+func validateFields(field string, fields []string) error {
+	if field != "" && len(fields) > 0 {
+		return errors.New("use either field or fields, not both")
+	}
+	return nil
+}
+
+func validateWeight(weight int) error {
+	if weight < 0 || weight > 100 {
+		return errors.Errorf("weight (%d) outside range 0-100", weight)
+	}
+	return nil
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", RuleModeOr, RuleModeAnd:
+		return nil
+	}
+	return errors.Errorf("unknown mode '%s', must be '%s' or '%s'", mode, RuleModeOr, RuleModeAnd)
+}
+
+func validateBucketing(bucketing string) error {
+	switch bucketing {
+	case "", BucketingSalted, BucketingLegacy:
+		return nil
+	}
+	return errors.Errorf("unknown bucketing '%s', must be '%s' or '%s'", bucketing, BucketingSalted, BucketingLegacy)
+}
+
+func validateOverlay(overlay string) error {
+	switch overlay {
+	case "", OverlayPatch, OverlayReplace:
+		return nil
+	}
+	return errors.Errorf("unknown overlay '%s', must be '%s' or '%s'", overlay, OverlayPatch, OverlayReplace)
+}
+
+func validateRamp(r Ramp) error {
+	linear := r.StartAt != nil || r.EndAt != nil
+	switch {
+	case linear && len(r.Steps) > 0:
+		return errors.New("use either start_at/end_at or steps, not both")
+	case linear && (r.StartAt == nil || r.EndAt == nil):
+		return errors.New("start_at and end_at must both be set")
+	case linear && !r.StartAt.Before(*r.EndAt):
+		return errors.New("start_at must be before end_at")
+	case !linear && len(r.Steps) == 0:
+		return errors.New("either start_at/end_at or steps must be set")
+	}
+
+	weights := []int{r.From, r.To}
+	for i, step := range r.Steps {
+		if i > 0 && !r.Steps[i-1].At.Before(step.At) {
+			return errors.Errorf("steps[%d]: steps must be in time order", i)
+		}
+		weights = append(weights, step.Weight)
+	}
+	for _, w := range weights {
+		if err := validateWeight(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
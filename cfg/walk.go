@@ -0,0 +1,161 @@
+package cfg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// eachWindow calls fn for the window of every feature and rule in the config,
+// in a stable order. path describes where the window is, for error messages.
+func (c Config) eachWindow(fn func(path string, w Window) error) error {
+	for _, name := range c.featureNames() {
+		feature := c.Features[name]
+		prefix := "features." + name
+		if err := fn(prefix, feature.Window); err != nil {
+			return err
+		}
+		for i, rule := range feature.Rules.Enable {
+			if err := fn(fmt.Sprintf("%s.rules.enable[%d]", prefix, i), rule.Window); err != nil {
+				return err
+			}
+		}
+		for i, rule := range feature.Rules.Disable {
+			if err := fn(fmt.Sprintf("%s.rules.disable[%d]", prefix, i), rule.Window); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fields returns the names of every var that the config's rules, variants and
+// segments match or hash, sorted.
+func (c Config) Fields() []string {
+	fields := map[string]bool{}
+	add := func(field string, more []string) {
+		for _, f := range append([]string{field}, more...) {
+			if f != "" {
+				fields[f] = true
+			}
+		}
+	}
+	var addConditions func(conds Conditions)
+	addConditions = func(conds Conditions) {
+		for _, cond := range append(append([]Condition(nil), conds.All...), conds.Any...) {
+			add(cond.Field, nil)
+			addConditions(cond.Conditions)
+		}
+		if conds.Not != nil {
+			add(conds.Not.Field, nil)
+			addConditions(conds.Not.Conditions)
+		}
+	}
+
+	for _, feature := range c.Features {
+		add(feature.Variants.Field, feature.Variants.Fields)
+		for _, rule := range feature.Rules.Enable {
+			add(rule.Field, rule.Fields)
+			addConditions(rule.Conditions)
+		}
+		for _, rule := range feature.Rules.Disable {
+			add(rule.Field, rule.Fields)
+			addConditions(rule.Conditions)
+		}
+		for _, rule := range feature.Rules.SetVars {
+			add(rule.Field, rule.Fields)
+			addConditions(rule.Conditions)
+		}
+	}
+	for _, segment := range c.Segments {
+		add(segment.Field, nil)
+		addConditions(segment.Conditions)
+	}
+
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EachMatchValues calls fn for every set of match values in the config,
+// including those in conditions, in a stable order. path describes where the
+// values are, for error messages.
+func (c Config) EachMatchValues(fn func(path string, m MatchValues) error) error {
+	return c.EachConditions(func(path string, values MatchValues, conds Conditions) error {
+		return fn(path+".values", values)
+	})
+}
+
+// EachConditions calls fn for every rule and condition in the config, in a
+// stable order, with its values and nested conditions. path describes where
+// they are, for error messages.
+func (c Config) EachConditions(fn func(path string, values MatchValues, conds Conditions) error) error {
+	for _, name := range c.featureNames() {
+		rules := c.Features[name].Rules
+		prefix := "features." + name + ".rules"
+		for i, rule := range rules.Enable {
+			if err := eachConditions(fmt.Sprintf("%s.enable[%d]", prefix, i), rule.Values, rule.Conditions, fn); err != nil {
+				return err
+			}
+		}
+		for i, rule := range rules.Disable {
+			if err := eachConditions(fmt.Sprintf("%s.disable[%d]", prefix, i), rule.Values, rule.Conditions, fn); err != nil {
+				return err
+			}
+		}
+		for i, rule := range rules.SetVars {
+			if err := eachConditions(fmt.Sprintf("%s.set_vars[%d]", prefix, i), rule.Values, rule.Conditions, fn); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range c.segmentNames() {
+		segment := c.Segments[name]
+		if err := eachConditions("segments."+name, segment.Values, segment.Conditions, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eachConditions(path string, values MatchValues, conds Conditions, fn func(string, MatchValues, Conditions) error) error {
+	if err := fn(path, values, conds); err != nil {
+		return err
+	}
+	for i, cond := range conds.All {
+		if err := eachConditions(fmt.Sprintf("%s.all[%d]", path, i), cond.Values, cond.Conditions, fn); err != nil {
+			return err
+		}
+	}
+	for i, cond := range conds.Any {
+		if err := eachConditions(fmt.Sprintf("%s.any[%d]", path, i), cond.Values, cond.Conditions, fn); err != nil {
+			return err
+		}
+	}
+	if conds.Not != nil {
+		return eachConditions(path+".not", conds.Not.Values, conds.Not.Conditions, fn)
+	}
+	return nil
+}
+
+// featureNames returns the names of all the features in the config, sorted.
+func (c Config) featureNames() []string {
+	names := make([]string, 0, len(c.Features))
+	for name := range c.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// segmentNames returns the names of all the segments in the config, sorted.
+func (c Config) segmentNames() []string {
+	names := make([]string, 0, len(c.Segments))
+	for name := range c.Segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
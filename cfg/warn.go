@@ -0,0 +1,79 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// yaml11Bools are the words YAML 1.1 reads as booleans, which YAML 1.2 (and so
+// the config) reads as strings.
+var yaml11Bools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true,
+	"n": true, "N": true, "no": true, "No": true, "NO": true,
+	"on": true, "On": true, "ON": true,
+	"off": true, "Off": true, "OFF": true,
+}
+
+// freeformRegexp matches the paths of the values that are decoded without a
+// type, so their type depends on how they're written.
+var freeformRegexp = regexp.MustCompile(`\.(?:set|payload)(?:\.|\[|$)`)
+
+// expiredWarnings warns about the features that have expired by now, to nudge
+// their owners to remove them.
+func (c Config) expiredWarnings(now time.Time) []error {
+	var warnings []error
+	for _, name := range c.Expired(now) {
+		feature := c.Features[name]
+		owner := ""
+		if feature.Owner != "" {
+			owner = fmt.Sprintf(" by its owner '%s'", feature.Owner)
+		}
+		warnings = append(warnings, c.Positions.positionError(errors.Errorf(
+			"features.%s.expires_at: feature '%s' expired at %s and should be removed from the config%s",
+			name, name, feature.ExpiresAt.Format(time.RFC3339), owner,
+		)))
+	}
+	return warnings
+}
+
+// boolWarnings warns about unquoted words like 'yes' and 'off' in the set_vars
+// and variant payloads in node, which is at path. They used to be booleans, as
+// the config was read as YAML 1.1, and are now strings, so clients would get a
+// different type back without the config changing.
+func boolWarnings(file, path string, node *yaml.Node) []error {
+	var warnings []error
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			warnings = append(warnings, boolWarnings(file, path, n)...)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := key.Value
+			if key.Value == "<<" {
+				keyPath = path
+			} else if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			warnings = append(warnings, boolWarnings(file, keyPath, value)...)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			warnings = append(warnings, boolWarnings(file, fmt.Sprintf("%s[%d]", path, i), n)...)
+		}
+	case yaml.ScalarNode:
+		if node.Style == 0 && yaml11Bools[node.Value] && freeformRegexp.MatchString(path) {
+			warnings = append(warnings, PositionError{
+				Position: Position{File: file, Line: node.Line, Column: node.Column},
+				Err: errors.Errorf("%s: '%s' is a string, not a boolean as it was before config files were read as YAML 1.2, "+
+					"use true or false for a boolean, or quote it to keep it a string", path, node.Value),
+			})
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,76 @@
+package cfg
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// watchDebounce is how long the directory has to be quiet before it is
+// reloaded. Editors and Kubernetes both tend to produce a burst of events for
+// a single logical change.
+const watchDebounce = 250 * time.Millisecond
+
+// WatchDir watches filePath (and any directories below it) and calls fn with
+// the result of LoadDir for env and merge every time something changes. This
+// includes the '..data' symlink swap that Kubernetes uses to atomically update
+// a mounted ConfigMap. It blocks until ctx is cancelled.
+func WatchDir(ctx context.Context, filePath, env, merge string, fn func(Config, error)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create watcher")
+	}
+	defer w.Close()
+
+	if err := watchDirs(w, filePath); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			timer.Reset(watchDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fn(Config{}, errors.Wrap(err, "watch"))
+		case <-timer.C:
+			// directories may have come and gone, so make sure they're
+			// all still being watched before reloading
+			if err := watchDirs(w, filePath); err != nil {
+				fn(Config{}, err)
+				continue
+			}
+			fn(LoadDir(filePath, env, merge))
+		}
+	}
+}
+
+func watchDirs(w *fsnotify.Watcher, filePath string) error {
+	return filepath.Walk(filePath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != filePath && isHidden(info) {
+			return filepath.SkipDir
+		}
+		return errors.Wrapf(w.Add(path), "watch '%s'", path)
+	})
+}
@@ -0,0 +1,117 @@
+package cfg_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/dylannz/feature-service/cfg"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cfg", func() {
+	Describe("WatchDir", func() {
+		var (
+			dir     string
+			cancel  context.CancelFunc
+			done    chan error
+			configs chan Config
+			errs    chan error
+		)
+
+		const featureYAML = `
+version: 1.0
+features:
+  %s:
+    rules:
+      enable:
+        - field: "customer_id"
+          weight: 10
+`
+
+		writeFile := func(name, contents string) {
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "watch")
+			Expect(err).NotTo(HaveOccurred())
+
+			configs = make(chan Config, 10)
+			errs = make(chan error, 10)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan error, 1)
+			go func() {
+				done <- WatchDir(ctx, dir, "", MergeOptIn, func(c Config, err error) {
+					if err != nil {
+						errs <- err
+						return
+					}
+					configs <- c
+				})
+			}()
+
+			// wait until the watcher has started by touching a file it will
+			// notice but not load
+			Eventually(func() chan Config {
+				writeFile("ready.txt", "")
+				return configs
+			}, "5s", "500ms").Should(Receive())
+		})
+
+		// latestFeatures returns the features from the most recently loaded
+		// config, ignoring any reloads that happened before it
+		latestFeatures := func() map[string]Feature {
+			var features map[string]Feature
+			for {
+				select {
+				case c := <-configs:
+					features = c.Features
+				default:
+					return features
+				}
+			}
+		}
+
+		AfterEach(func() {
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+			os.RemoveAll(dir)
+		})
+
+		It("reloads the config when a file is added", func() {
+			writeFile("a.yml", fmt.Sprintf(featureYAML, "feature_a"))
+			Eventually(latestFeatures, "5s").Should(HaveKey("feature_a"))
+		})
+
+		It("reports an error when the new config can't be loaded", func() {
+			writeFile("a.yml", "features: [")
+			var err error
+			Eventually(errs, "5s").Should(Receive(&err))
+			Expect(err.Error()).To(ContainSubstring("a.yml"))
+		})
+
+		It("reloads the config when the '..data' symlink is swapped", func() {
+			// mimic the way Kubernetes updates a mounted ConfigMap
+			for i, feature := range []string{"feature_a", "feature_b"} {
+				version := fmt.Sprintf("..v%d", i)
+				Expect(os.Mkdir(filepath.Join(dir, version), 0755)).To(Succeed())
+				writeFile(filepath.Join(version, "a.yml"), fmt.Sprintf(featureYAML, feature))
+				Expect(os.Symlink(version, filepath.Join(dir, "..data_tmp"))).To(Succeed())
+				Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+				if i == 0 {
+					Expect(os.Symlink(filepath.Join("..data", "a.yml"), filepath.Join(dir, "a.yml"))).To(Succeed())
+				}
+
+				Eventually(latestFeatures, "5s").Should(And(HaveLen(1), HaveKey(feature)))
+			}
+		})
+	})
+})
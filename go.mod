@@ -3,16 +3,18 @@ module github.com/dylannz/feature-service
 go 1.16
 
 require (
-	github.com/Netflix/go-env v0.0.0-20210215222557-e437a7e7f9fb // indirect
-	github.com/deepmap/oapi-codegen v1.6.0 // indirect
-	github.com/go-chi/chi v1.5.4 // indirect
-	github.com/go-chi/chi/v5 v5.0.2 // indirect
-	github.com/golang/mock v1.5.0 // indirect
-	github.com/google/uuid v1.2.0 // indirect
+	github.com/Netflix/go-env v0.0.0-20210215222557-e437a7e7f9fb
+	github.com/deepmap/oapi-codegen v1.6.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-chi/chi v1.5.4
+	github.com/go-chi/chi/v5 v5.0.2
+	github.com/golang/mock v1.5.0
+	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/onsi/ginkgo v1.16.1 // indirect
-	github.com/onsi/gomega v1.11.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/onsi/ginkgo v1.16.1
+	github.com/onsi/gomega v1.11.0
+	github.com/pelletier/go-toml/v2 v2.1.0
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
 )
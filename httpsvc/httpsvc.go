@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/dylannz/feature-service/reqcontext"
+	"github.com/dylannz/feature-service/service"
 	"github.com/dylannz/feature-service/spec"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
@@ -22,6 +23,9 @@ type HTTPService struct {
 //go:generate mockgen -source=httpsvc.go -destination=mock/httpsvc.go
 type Service interface {
 	FeaturesStatus(ctx context.Context, req spec.FeaturesRequest, feature string) (*spec.FeaturesResponse, error)
+	FeaturesStatusBatch(ctx context.Context, req spec.BatchRequest) (*spec.BatchResponse, error)
+	Catalog(ctx context.Context, redact bool) (*spec.FeatureCatalog, error)
+	Feature(ctx context.Context, feature string, redact bool) (*spec.FeatureInfo, error)
 }
 
 func NewHTTPHandler(logger logrus.FieldLogger, service Service) http.Handler {
@@ -41,41 +45,122 @@ func (s HTTPService) handleHealth(w http.ResponseWriter, r *http.Request) {
 	// just return 200
 }
 
+func (s HTTPService) GetFeatures(w http.ResponseWriter, r *http.Request, params spec.GetFeaturesParams) {
+	res, err := s.service.Catalog(requestContext(r), params.Redact != nil && bool(*params.Redact))
+	if err != nil {
+		s.writeServiceError(w, err)
+		return
+	}
+	s.writeResponse(w, res)
+}
+
+func (s HTTPService) GetFeaturesName(w http.ResponseWriter, r *http.Request, name string, params spec.GetFeaturesNameParams) {
+	res, err := s.service.Feature(requestContext(r), name, params.Redact != nil && bool(*params.Redact))
+	if err != nil {
+		s.writeServiceError(w, err)
+		return
+	}
+	s.writeResponse(w, res)
+}
+
 func (s HTTPService) PostFeaturesStatus(w http.ResponseWriter, r *http.Request) {
 	s.PostFeaturesStatusFeature(w, r, "")
 }
 
 func (s HTTPService) PostFeaturesStatusFeature(w http.ResponseWriter, r *http.Request, feature string) {
 	var req spec.FeaturesRequest
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		s.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
+	if !s.decodeRequest(w, r, &req) {
 		return
 	}
 
-	err = json.Unmarshal(body, &req)
+	res, err := s.service.FeaturesStatus(requestContext(r), req, feature)
 	if err != nil {
-		s.logger.Error(errors.Wrap(err, "decode request body"))
-		w.WriteHeader(http.StatusBadRequest)
+		s.writeServiceError(w, err)
+		return
+	}
+	s.writeResponse(w, res)
+}
+
+func (s HTTPService) PostFeaturesBatch(w http.ResponseWriter, r *http.Request) {
+	var req spec.BatchRequest
+	if !s.decodeRequest(w, r, &req) {
 		return
 	}
 
-	ctx := r.Context()
-	ctx = reqcontext.ContextWithRequestID(ctx, r.Header.Get("x-request-id"))
-	res, err := s.service.FeaturesStatus(ctx, req, feature)
+	res, err := s.service.FeaturesStatusBatch(requestContext(r), req)
 	if err != nil {
-		s.logger.Error(errors.Wrap(err, "service"))
-		w.WriteHeader(http.StatusInternalServerError)
+		s.writeServiceError(w, err)
 		return
 	}
+	s.writeResponse(w, res)
+}
+
+func requestContext(r *http.Request) context.Context {
+	return reqcontext.ContextWithRequestID(r.Context(), r.Header.Get("x-request-id"))
+}
 
-	responseBody, err := json.Marshal(res)
+// decodeRequest decodes the JSON request body into v. If it can't, it writes
+// an error response and returns false.
+func (s HTTPService) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error(err)
+		s.writeError(w, http.StatusBadRequest, spec.ErrorCodeInvalidRequest, "couldn't read request body")
+		return false
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		s.logger.Debug(errors.Wrap(err, "decode request body"))
+		s.writeError(w, http.StatusBadRequest, spec.ErrorCodeInvalidRequest, errors.Wrap(err, "decode request body").Error())
+		return false
+	}
+	return true
+}
+
+func (s HTTPService) writeResponse(w http.ResponseWriter, v interface{}) {
+	responseBody, err := json.Marshal(v)
 	if err != nil {
 		s.logger.Error(errors.Wrap(err, "encode response body"))
-		w.WriteHeader(http.StatusInternalServerError)
+		s.writeError(w, http.StatusInternalServerError, spec.ErrorCodeInternal, "internal error")
+		return
+	}
+
+	w.Write(responseBody)
+}
+
+// writeServiceError writes the response for an error from the service.
+// Errors caused by the caller are only logged at debug level, so they don't
+// look like problems with the service.
+func (s HTTPService) writeServiceError(w http.ResponseWriter, err error) {
+	var unknownFeature service.UnknownFeatureError
+	var invalidVars service.InvalidVarsError
+	var invalidRequest service.InvalidRequestError
+	switch {
+	case errors.As(err, &unknownFeature):
+		s.logger.Debug(errors.Wrap(err, "service"))
+		s.writeError(w, http.StatusNotFound, spec.ErrorCodeUnknownFeature, err.Error())
+	case errors.As(err, &invalidVars):
+		s.logger.Debug(errors.Wrap(err, "service"))
+		s.writeError(w, http.StatusUnprocessableEntity, spec.ErrorCodeInvalidVars, err.Error())
+	case errors.As(err, &invalidRequest):
+		s.logger.Debug(errors.Wrap(err, "service"))
+		s.writeError(w, http.StatusBadRequest, spec.ErrorCodeInvalidRequest, err.Error())
+	default:
+		s.logger.Error(errors.Wrap(err, "service"))
+		s.writeError(w, http.StatusInternalServerError, spec.ErrorCodeInternal, "internal error")
+	}
+}
+
+func (s HTTPService) writeError(w http.ResponseWriter, status int, code, message string) {
+	responseBody, err := json.Marshal(spec.Error{Code: code, Message: message})
+	if err != nil {
+		s.logger.Error(errors.Wrap(err, "encode error body"))
+		w.WriteHeader(status)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(responseBody)
 }
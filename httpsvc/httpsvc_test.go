@@ -8,10 +8,13 @@ import (
 
 	. "github.com/dylannz/feature-service/httpsvc"
 	mock_httpsvc "github.com/dylannz/feature-service/httpsvc/mock"
+	"github.com/dylannz/feature-service/service"
 	"github.com/dylannz/feature-service/spec"
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -110,4 +113,167 @@ var _ = Describe("httpsvc", func() {
 			`))
 		})
 	})
+
+	Describe("/features", func() {
+		It("returns the feature catalog", func() {
+			logger := logrus.WithField("httpsvc", "test")
+			ctrl := gomock.NewController(GinkgoT())
+			defer ctrl.Finish()
+			svc := mock_httpsvc.NewMockService(ctrl)
+
+			owner := "team-payments"
+			catalog := spec.NewFeatureCatalog()
+			(*catalog.Features)["checkout_v3"] = spec.FeatureInfo{Owner: &owner}
+			svc.EXPECT().Catalog(gomock.Any(), true).Return(catalog, nil)
+
+			server := httptest.NewServer(NewHTTPHandler(logger, svc))
+			res, err := server.Client().Get(server.URL + "/features?redact=true")
+			Expect(err).NotTo(HaveOccurred())
+			b, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(MatchJSON(`
+				{
+					"features": {
+						"checkout_v3": {
+							"owner": "team-payments"
+						}
+					}
+				}
+			`))
+		})
+	})
+
+	Describe("/features/{name}", func() {
+		It("returns the feature's metadata and rules", func() {
+			logger := logrus.WithField("httpsvc", "test")
+			ctrl := gomock.NewController(GinkgoT())
+			defer ctrl.Finish()
+			svc := mock_httpsvc.NewMockService(ctrl)
+
+			owner := "team-payments"
+			svc.EXPECT().Feature(gomock.Any(), "checkout_v3", false).Return(&spec.FeatureInfo{Owner: &owner}, nil)
+
+			server := httptest.NewServer(NewHTTPHandler(logger, svc))
+			res, err := server.Client().Get(server.URL + "/features/checkout_v3")
+			Expect(err).NotTo(HaveOccurred())
+			b, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(MatchJSON(`{"owner": "team-payments"}`))
+		})
+	})
+
+	Describe("/features/batch", func() {
+		It("returns the results for each item", func() {
+			logger := logrus.WithField("httpsvc", "test")
+			ctrl := gomock.NewController(GinkgoT())
+			defer ctrl.Finish()
+			svc := mock_httpsvc.NewMockService(ctrl)
+
+			key := "customer_5671"
+			vars := map[string]interface{}{"customer_id": "5671"}
+			svc.EXPECT().
+				FeaturesStatusBatch(gomock.Any(), spec.BatchRequest{
+					Items: []spec.BatchItem{{Key: &key, Vars: &vars}},
+				}).
+				Return(
+					spec.NewBatchResponse().
+						AddResult(key, spec.NewFeaturesResponse().AddStatus("stripe_billing", true, nil).Features),
+					nil,
+				)
+
+			server := httptest.NewServer(NewHTTPHandler(logger, svc))
+			res, err := server.Client().Post(
+				server.URL+"/features/batch",
+				"application/json",
+				strings.NewReader(`
+				{
+					"items": [
+						{"key": "customer_5671", "vars": {"customer_id": "5671"}}
+					]
+				}
+				`),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			b, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(MatchJSON(`
+				{
+					"results": {
+						"customer_5671": {
+							"features": {
+								"stripe_billing": {
+									"enabled": true
+								}
+							}
+						}
+					}
+				}
+			`))
+		})
+	})
+
+	Describe("errors", func() {
+		var (
+			ctrl   *gomock.Controller
+			svc    *mock_httpsvc.MockService
+			server *httptest.Server
+		)
+
+		BeforeEach(func() {
+			ctrl = gomock.NewController(GinkgoT())
+			svc = mock_httpsvc.NewMockService(ctrl)
+			server = httptest.NewServer(NewHTTPHandler(logrus.WithField("httpsvc", "test"), svc))
+		})
+
+		AfterEach(func() {
+			server.Close()
+			ctrl.Finish()
+		})
+
+		post := func(path, body string) (int, []byte) {
+			res, err := server.Client().Post(server.URL+path, "application/json", strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return res.StatusCode, b
+		}
+
+		DescribeTable(
+			"maps service errors to status codes",
+			func(serviceErr error, expectedStatus int, expectedBody string) {
+				svc.EXPECT().
+					FeaturesStatus(gomock.Any(), gomock.Any(), "stripe_billing").
+					Return(nil, serviceErr)
+
+				status, body := post("/features/status/stripe_billing", `{"vars":{"customer_id":"5671"}}`)
+				Expect(status).To(Equal(expectedStatus))
+				Expect(body).To(MatchJSON(expectedBody))
+			},
+			Entry(
+				"unknown feature",
+				service.UnknownFeatureError{Feature: "stripe_billing"},
+				http.StatusNotFound,
+				`{"code":"UNKNOWN_FEATURE","message":"unknown feature: 'stripe_billing'"}`,
+			),
+			Entry(
+				"invalid vars",
+				errors.Wrap(service.InvalidVarsError{Field: "customer", Reason: "objects aren't supported"}, "evaluate"),
+				http.StatusUnprocessableEntity,
+				`{"code":"INVALID_VARS","message":"evaluate: invalid var 'customer': objects aren't supported"}`,
+			),
+			Entry(
+				"anything else",
+				errors.New("something broke"),
+				http.StatusInternalServerError,
+				`{"code":"INTERNAL","message":"internal error"}`,
+			),
+		)
+
+		It("returns a bad request error when the body isn't valid JSON", func() {
+			status, body := post("/features/status", `{"vars":`)
+			Expect(status).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"code":"INVALID_REQUEST","message":"decode request body: unexpected end of JSON input"}`))
+		})
+	})
 })
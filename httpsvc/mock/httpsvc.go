@@ -35,6 +35,36 @@ func (m *MockService) EXPECT() *MockServiceMockRecorder {
 	return m.recorder
 }
 
+// Catalog mocks base method.
+func (m *MockService) Catalog(ctx context.Context, redact bool) (*spec.FeatureCatalog, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Catalog", ctx, redact)
+	ret0, _ := ret[0].(*spec.FeatureCatalog)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Catalog indicates an expected call of Catalog.
+func (mr *MockServiceMockRecorder) Catalog(ctx, redact interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Catalog", reflect.TypeOf((*MockService)(nil).Catalog), ctx, redact)
+}
+
+// Feature mocks base method.
+func (m *MockService) Feature(ctx context.Context, feature string, redact bool) (*spec.FeatureInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Feature", ctx, feature, redact)
+	ret0, _ := ret[0].(*spec.FeatureInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Feature indicates an expected call of Feature.
+func (mr *MockServiceMockRecorder) Feature(ctx, feature, redact interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Feature", reflect.TypeOf((*MockService)(nil).Feature), ctx, feature, redact)
+}
+
 // FeaturesStatus mocks base method.
 func (m *MockService) FeaturesStatus(ctx context.Context, req spec.FeaturesRequest, feature string) (*spec.FeaturesResponse, error) {
 	m.ctrl.T.Helper()
@@ -49,3 +79,18 @@ func (mr *MockServiceMockRecorder) FeaturesStatus(ctx, req, feature interface{})
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FeaturesStatus", reflect.TypeOf((*MockService)(nil).FeaturesStatus), ctx, req, feature)
 }
+
+// FeaturesStatusBatch mocks base method.
+func (m *MockService) FeaturesStatusBatch(ctx context.Context, req spec.BatchRequest) (*spec.BatchResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FeaturesStatusBatch", ctx, req)
+	ret0, _ := ret[0].(*spec.BatchResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FeaturesStatusBatch indicates an expected call of FeaturesStatusBatch.
+func (mr *MockServiceMockRecorder) FeaturesStatusBatch(ctx, req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FeaturesStatusBatch", reflect.TypeOf((*MockService)(nil).FeaturesStatusBatch), ctx, req)
+}
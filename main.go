@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	_ "time/tzdata" // for schedule time zones, the docker image has no tz database
 
 	"github.com/Netflix/go-env"
 	"github.com/dylannz/feature-service/cfg"
@@ -16,14 +19,21 @@ import (
 type Env struct {
 	LogLevel  string `env:"LOG_LEVEL"`
 	ConfigDir string `env:"CONFIG_DIR"`
-	HTTPAddr  string `env:"HTTP_ADDR"`
+	// ConfigEnv picks the overlay files to apply to the config, e.g. 'prod'
+	// for 'stripe.prod.yaml'.
+	ConfigEnv string `env:"CONFIG_ENV"`
+	// ConfigMerge is the policy for features defined in more than one
+	// config file: 'error', 'opt-in' or 'append'.
+	ConfigMerge string `env:"CONFIG_MERGE"`
+	HTTPAddr    string `env:"HTTP_ADDR"`
 }
 
 func initEnv() Env {
 	e := Env{
-		LogLevel:  "info",
-		ConfigDir: "./config",
-		HTTPAddr:  "127.0.0.1:3000",
+		LogLevel:    "info",
+		ConfigDir:   "./config",
+		ConfigMerge: cfg.MergeOptIn,
+		HTTPAddr:    "127.0.0.1:3000",
 	}
 
 	_, err := env.UnmarshalFromEnviron(&e)
@@ -40,16 +50,52 @@ func initEnv() Env {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	e := initEnv()
 	logger := logrus.WithField("service", "feature-service")
 
-	config, err := cfg.LoadYAMLDir(e.ConfigDir)
+	config, err := cfg.LoadDir(e.ConfigDir, e.ConfigEnv, e.ConfigMerge)
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	logWarnings(logger, config)
 
 	svc := service.NewService(logger, config)
+	go watchConfig(logger, e.ConfigDir, e.ConfigEnv, e.ConfigMerge, svc)
+
 	h := httpsvc.NewHTTPHandler(logger, svc)
 	logger.Info("listening for http traffic on: ", e.HTTPAddr)
 	logger.Fatal(http.ListenAndServe(e.HTTPAddr, h))
 }
+
+// watchConfig reloads the config whenever the config directory changes. If the
+// new config can't be loaded the service keeps using the last good one.
+func watchConfig(logger logrus.FieldLogger, configDir, configEnv, configMerge string, svc *service.Service) {
+	err := cfg.WatchDir(context.Background(), configDir, configEnv, configMerge, func(config cfg.Config, err error) {
+		if err != nil {
+			logger.Error(errors.Wrap(err, "reload config, keeping previous config"))
+			return
+		}
+		logWarnings(logger, config)
+		svc.SetConfig(config)
+		logger.Info("reloaded config from: ", configDir)
+	})
+	if err != nil {
+		logger.Error(errors.Wrap(err, "watch config"))
+	}
+}
+
+// logWarnings logs the problems with a config that didn't stop it loading.
+func logWarnings(logger logrus.FieldLogger, config cfg.Config) {
+	for _, w := range config.Warnings {
+		logger.Warn(w)
+	}
+}
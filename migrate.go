@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dylannz/feature-service/cfg"
+)
+
+// runMigrate rewrites the config files in a directory in the latest schema
+// version. Only YAML files can be rewritten, so JSON and TOML files in an older
+// version are reported and make it fail. Every file is migrated, and the
+// directory checked to load with the migrated files, before any are written,
+// so a file that can't be migrated doesn't leave the directory half migrated.
+// It returns the process exit code.
+func runMigrate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dryRun := flags.Bool("dry-run", false, "print the migrated files instead of writing them")
+	merge := flags.String("merge", cfg.MergeOptIn, "the policy for features defined in more than one file, 'error', 'opt-in' or 'append', as CONFIG_MERGE")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: feature-service migrate [-dry-run] [-merge <policy>] <dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	dir := flags.Arg(0)
+	files, err := cfg.Files(dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	code := 0
+	migrated := map[string][]byte{}
+	for _, path := range files {
+		b, ok, err := migrateFile(path)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "%s: not migrated, only YAML files can be migrated, rewrite it in version 2.0 by hand\n", path)
+			code = 1
+			continue
+		}
+		if b != nil {
+			migrated[path] = b
+		}
+	}
+	if err := cfg.CheckMigration(dir, *merge, migrated); err != nil {
+		fmt.Fprintf(stderr, "%s: not migrated, the migrated config doesn't load: %s\n", dir, err)
+		return 1
+	}
+
+	for _, path := range files {
+		b, ok := migrated[path]
+		if !ok {
+			continue
+		}
+		if *dryRun {
+			fmt.Fprintf(stdout, "# %s\n%s", path, b)
+			continue
+		}
+		if err := writeFile(path, b); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "migrated %s\n", path)
+	}
+	return code
+}
+
+// migrateFile returns a config file rewritten in the latest schema version, or
+// nil if it's already in the latest version. It returns false if the file
+// needs migrating but can't be.
+func migrateFile(path string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		needed, err := cfg.NeedsMigration(bytes.NewReader(b), path)
+		return nil, !needed, err
+	}
+
+	migrated, changed, err := cfg.MigrateYAML(b, path)
+	if err != nil || !changed {
+		return nil, err == nil, err
+	}
+	return migrated, true, nil
+}
+
+// writeFile replaces the contents of a file, keeping its mode.
+func writeFile(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, info.Mode())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("migrate", func() {
+	var (
+		dir            string
+		stdout, stderr bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "migrate")
+		Expect(err).NotTo(HaveOccurred())
+		stdout.Reset()
+		stderr.Reset()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// copyFixture copies a file from the cfg fixtures into dir
+	copyFixture := func(fixture, name string) string {
+		b, err := ioutil.ReadFile(filepath.Join("./cfg/fixtures", fixture))
+		Expect(err).NotTo(HaveOccurred())
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, b, 0644)).To(Succeed())
+		return path
+	}
+
+	readFile := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return string(b)
+	}
+
+	It("rewrites version 1 files and leaves the others alone", func() {
+		v1 := copyFixture("migrate/v1.yml", "billing.yml")
+		v2 := copyFixture("formats/yaml.yml", "search.yml")
+		Expect(runMigrate([]string{dir}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("migrated " + v1 + "\n"))
+		Expect(stderr.String()).To(BeEmpty())
+		Expect(readFile(v1)).To(Equal(readFile("./cfg/fixtures/migrate/v2.yml")))
+		Expect(readFile(v2)).To(Equal(readFile("./cfg/fixtures/formats/yaml.yml")))
+	})
+
+	It("prints the migrated files without writing them with -dry-run", func() {
+		v1 := copyFixture("migrate/v1.yml", "billing.yml")
+		Expect(runMigrate([]string{"-dry-run", dir}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("# " + v1 + "\n" + readFile("./cfg/fixtures/migrate/v2.yml")))
+		Expect(readFile(v1)).To(Equal(readFile("./cfg/fixtures/migrate/v1.yml")))
+	})
+
+	It("fails for invalid files, giving the file and line", func() {
+		bad := copyFixture("invalid_weight/bad.yml", "bad.yml")
+		Expect(runMigrate([]string{dir}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(BeEmpty())
+		Expect(stderr.String()).To(Equal(
+			bad + ":9:11: features.stripe_billing.rules.enable[0].weight: weight (150) outside range 0-100\n",
+		))
+	})
+
+	It("doesn't write any files unless every file can be migrated", func() {
+		a := filepath.Join(dir, "a.yaml")
+		b := filepath.Join(dir, "b.yaml")
+		feature := "version: 1.0\nfeatures:\n  f:\n    merge: true\n    rules:\n      enable:\n        - field: \"customer_id\"\n          %s: 50\n"
+		Expect(ioutil.WriteFile(a, []byte(fmt.Sprintf(feature, "weight")), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(b, []byte(fmt.Sprintf(feature, "weigth")), 0644)).To(Succeed())
+
+		Expect(runMigrate([]string{dir}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(BeEmpty())
+		Expect(stderr.String()).To(HavePrefix(b + ":8:11: features.f.rules.enable[0].weigth: field weigth not found"))
+		Expect(readFile(a)).To(Equal(fmt.Sprintf(feature, "weight")))
+	})
+
+	It("doesn't write any files if the migrated config doesn't load", func() {
+		a := filepath.Join(dir, "a.yaml")
+		feature := "version: 1.0\nfeatures:\n  f:\n    merge: true\n    rules:\n      enable:\n        - field: \"customer_id\"\n          weight: 50\n"
+		Expect(ioutil.WriteFile(a, []byte(feature), 0644)).To(Succeed())
+		b := filepath.Join(dir, "b.json")
+		Expect(ioutil.WriteFile(b, []byte(`{"version": "1.0", "features": {"f": {"merge": true}}}`), 0644)).To(Succeed())
+
+		Expect(runMigrate([]string{dir}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(BeEmpty())
+		Expect(stderr.String()).To(Equal(
+			b + ": not migrated, only YAML files can be migrated, rewrite it in version 2.0 by hand\n" +
+				dir + ": not migrated, the migrated config doesn't load: " + b + ":1:33: features.f: already defined in '" + a +
+				"' with version '2.0', a feature can only be merged across files with the same version, not '1.0'\n",
+		))
+		Expect(readFile(a)).To(Equal(feature))
+	})
+
+	It("reports version 1 files it can't rewrite", func() {
+		v1 := copyFixture("migrate/v1.yml", "billing.yml")
+		copyFixture("formats/json.json", "search.json")
+		json := filepath.Join(dir, "stripe.json")
+		Expect(ioutil.WriteFile(json, []byte(`{"features": {"checkout_v2": {"rules": {"enable": [{"field": "customer_id", "weight": 50}]}}}}`), 0644)).To(Succeed())
+
+		Expect(runMigrate([]string{dir}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(Equal("migrated " + v1 + "\n"))
+		Expect(stderr.String()).To(Equal(json + ": not migrated, only YAML files can be migrated, rewrite it in version 2.0 by hand\n"))
+	})
+})
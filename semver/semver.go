@@ -0,0 +1,108 @@
+// Package semver parses and compares semantic versions (https://semver.org).
+package semver
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease []string
+}
+
+// Parse parses a semantic version. To cope with the way app versions are
+// usually reported, a leading 'v' is allowed and a missing minor or patch
+// version is treated as 0, e.g. 'v4.2' is the same as '4.2.0'. Build metadata
+// is ignored.
+func Parse(s string) (Version, error) {
+	v := Version{}
+	str := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(str, '+'); i >= 0 {
+		str = str[:i]
+	}
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		v.Prerelease = strings.Split(str[i+1:], ".")
+		for _, p := range v.Prerelease {
+			if p == "" {
+				return v, errors.Errorf("invalid semantic version: '%s'", s)
+			}
+		}
+		str = str[:i]
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return v, errors.Errorf("invalid semantic version: '%s'", s)
+	}
+	nums := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, errors.Errorf("invalid semantic version: '%s'", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// Compare returns -1 if a < b, 0 if a == b and 1 if a > b, following the
+// precedence rules in the semver spec.
+func Compare(a, b Version) int {
+	if c := compareUint(a.Major, b.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(a.Minor, b.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(a.Patch, b.Patch); c != 0 {
+		return c
+	}
+
+	// a version without a prerelease has higher precedence than one with
+	switch {
+	case len(a.Prerelease) == 0 && len(b.Prerelease) == 0:
+		return 0
+	case len(a.Prerelease) == 0:
+		return 1
+	case len(b.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a.Prerelease) && i < len(b.Prerelease); i++ {
+		if c := comparePrerelease(a.Prerelease[i], b.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(a.Prerelease)), uint64(len(b.Prerelease)))
+}
+
+// comparePrerelease compares two prerelease identifiers. Numeric identifiers
+// are compared numerically and have lower precedence than alphanumeric ones.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
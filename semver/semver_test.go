@@ -0,0 +1,52 @@
+package semver_test
+
+import (
+	. "github.com/dylannz/feature-service/semver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("semver", func() {
+	DescribeTable(
+		"Parse",
+		func(s string, expected Version, expectedErr bool) {
+			v, err := Parse(s)
+			if expectedErr {
+				Expect(err).To(MatchError(ContainSubstring("invalid semantic version")))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal(expected))
+		},
+		Entry("full version", "4.2.1", Version{Major: 4, Minor: 2, Patch: 1}, false),
+		Entry("leading v", "v4.2.1", Version{Major: 4, Minor: 2, Patch: 1}, false),
+		Entry("missing patch", "4.2", Version{Major: 4, Minor: 2}, false),
+		Entry("prerelease and build", "4.2.1-beta.2+abc", Version{Major: 4, Minor: 2, Patch: 1, Prerelease: []string{"beta", "2"}}, false),
+		Entry("empty", "", Version{}, true),
+		Entry("too many parts", "4.2.1.0", Version{}, true),
+		Entry("not a number", "4.x", Version{}, true),
+		Entry("empty prerelease identifier", "4.2.1-beta..1", Version{}, true),
+	)
+
+	DescribeTable(
+		"Compare",
+		func(a, b string, expected int) {
+			va, err := Parse(a)
+			Expect(err).NotTo(HaveOccurred())
+			vb, err := Parse(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(Compare(va, vb)).To(Equal(expected))
+			Expect(Compare(vb, va)).To(Equal(-expected))
+		},
+		Entry("equal", "4.2.0", "v4.2", 0),
+		Entry("major", "5.0.0", "4.9.9", 1),
+		Entry("minor is compared numerically", "4.10.0", "4.9.0", 1),
+		Entry("patch", "4.2.1", "4.2.2", -1),
+		Entry("prerelease is lower than release", "4.2.0-rc.1", "4.2.0", -1),
+		Entry("numeric prerelease identifiers", "4.2.0-rc.10", "4.2.0-rc.9", 1),
+		Entry("numeric identifiers are lower than alphanumeric", "4.2.0-1", "4.2.0-alpha", -1),
+		Entry("more prerelease identifiers is higher", "4.2.0-alpha.1", "4.2.0-alpha", 1),
+		Entry("build metadata is ignored", "4.2.0+1", "4.2.0+2", 0),
+	)
+})
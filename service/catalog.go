@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dylannz/feature-service/cfg"
+	"github.com/dylannz/feature-service/spec"
+)
+
+// Catalog lists every feature in the config with its metadata and rules. If
+// redact is true, lists of values that rules match exactly are replaced with
+// the number of values, as they might contain personal information, and the
+// values set_vars rules set are hidden, as they might be secrets resolved from
+// files or the environment.
+func (s *Service) Catalog(ctx context.Context, redact bool) (*spec.FeatureCatalog, error) {
+	st := s.current()
+	now := s.clock.Now()
+
+	res := spec.NewFeatureCatalog().SetConfigVersion(st.config.Revision)
+	for _, name := range st.featureList {
+		(*res.Features)[name] = featureInfo(st.config.Features[name], now, redact)
+	}
+	return res, nil
+}
+
+// Feature returns a feature's metadata and rules, like Catalog.
+func (s *Service) Feature(ctx context.Context, featureName string, redact bool) (*spec.FeatureInfo, error) {
+	st := s.current()
+	feature, ok := st.config.Features[featureName]
+	if !ok {
+		return nil, UnknownFeatureError{Feature: featureName}
+	}
+	info := featureInfo(feature, s.clock.Now(), redact)
+	return &info, nil
+}
+
+func featureInfo(feature cfg.Feature, now time.Time, redact bool) spec.FeatureInfo {
+	expired := feature.ExpiresAt != nil && !now.Before(*feature.ExpiresAt)
+	info := spec.FeatureInfo{
+		CreatedAt: feature.CreatedAt,
+		ExpiresAt: feature.ExpiresAt,
+		Expired:   &expired,
+		Rules:     &spec.RuleSummaries{},
+	}
+	if feature.Description != "" {
+		info.Description = &feature.Description
+	}
+	if feature.Owner != "" {
+		info.Owner = &feature.Owner
+	}
+	if len(feature.Tags) > 0 {
+		info.Tags = &feature.Tags
+	}
+	if len(feature.Sources) > 0 {
+		info.Sources = &feature.Sources
+	}
+
+	if len(feature.Requires) > 0 {
+		requires := make([]spec.Prerequisite, 0, len(feature.Requires))
+		for _, req := range feature.Requires {
+			p := spec.Prerequisite{Feature: stringPtr(req.Feature)}
+			if req.Variant != "" {
+				p.Variant = stringPtr(req.Variant)
+			}
+			requires = append(requires, p)
+		}
+		info.Requires = &requires
+	}
+	if len(feature.Variants.Allocation) > 0 {
+		variants := make([]spec.VariantSummary, 0, len(feature.Variants.Allocation))
+		for _, v := range feature.Variants.Allocation {
+			variants = append(variants, spec.VariantSummary{Name: stringPtr(v.Name), Weight: intPtr(v.Weight)})
+		}
+		info.Variants = &variants
+	}
+
+	if len(feature.Rules.Enable) > 0 {
+		rules := make([]spec.RuleSummary, 0, len(feature.Rules.Enable))
+		for _, rule := range feature.Rules.Enable {
+			r := ruleSummary(rule.ID, rule.Window, ruleFields(rule.Field, rule.Fields), rule.Values, rule.Conditions, redact)
+			if rule.Mode != "" {
+				r.Mode = stringPtr(rule.Mode)
+			}
+			if rule.Weight != nil || rule.Ramp != nil {
+				r.Weight = intPtr(rampWeight(rule, now))
+			}
+			if rule.Ramp != nil {
+				ramp := true
+				r.Ramp = &ramp
+			}
+			if rule.Variant != "" {
+				r.Variant = stringPtr(rule.Variant)
+			}
+			rules = append(rules, r)
+		}
+		info.Rules.Enable = &rules
+	}
+	if len(feature.Rules.Disable) > 0 {
+		rules := make([]spec.RuleSummary, 0, len(feature.Rules.Disable))
+		for _, rule := range feature.Rules.Disable {
+			rules = append(rules, ruleSummary(rule.ID, rule.Window, ruleFields(rule.Field, rule.Fields), rule.Values, rule.Conditions, redact))
+		}
+		info.Rules.Disable = &rules
+	}
+	if len(feature.Rules.SetVars) > 0 {
+		rules := make([]spec.RuleSummary, 0, len(feature.Rules.SetVars))
+		for _, rule := range feature.Rules.SetVars {
+			r := ruleSummary("", cfg.Window{}, ruleFields(rule.Field, rule.Fields), rule.Values, rule.Conditions, redact)
+			if rule.Mode != "" {
+				r.Mode = stringPtr(rule.Mode)
+			}
+			if rule.Weight != nil {
+				r.Weight = intPtr(*rule.Weight)
+			}
+			if len(rule.Set) > 0 {
+				set := rule.Set
+				if redact {
+					set = redactVars(set)
+				}
+				r.Set = &set
+			}
+			rules = append(rules, r)
+		}
+		info.Rules.SetVars = &rules
+	}
+	return info
+}
+
+func ruleSummary(id string, w cfg.Window, fields []string, values cfg.MatchValues, conds cfg.Conditions, redact bool) spec.RuleSummary {
+	r := spec.RuleSummary{
+		StartAt: w.StartAt,
+		EndAt:   w.EndAt,
+	}
+	if id != "" {
+		r.Id = stringPtr(id)
+	}
+	if w.Schedule != nil {
+		schedule := true
+		r.Schedule = &schedule
+	}
+	if match := describeMatch(fields, values, conds, redact); match != "" {
+		r.Match = &match
+	}
+	return r
+}
+
+// describeMatch describes the vars that values and conditions match, e.g.
+// `customer_id in ["123", "456"] and all(country eq ["NZ"])`.
+func describeMatch(fields []string, values cfg.MatchValues, conds cfg.Conditions, redact bool) string {
+	var parts []string
+	if !values.IsZero() {
+		field := strings.Join(fields, ", ")
+		if len(fields) > 1 {
+			field = "any of (" + field + ")"
+		}
+		parts = append(parts, field+" "+describeValues(values, redact))
+	}
+	if c := describeConditions(conds, redact); c != "" {
+		parts = append(parts, c)
+	}
+	return strings.Join(parts, " and ")
+}
+
+func describeConditions(c cfg.Conditions, redact bool) string {
+	var parts []string
+	describeAll := func(op string, conds []cfg.Condition) {
+		if len(conds) == 0 {
+			return
+		}
+		descs := make([]string, 0, len(conds))
+		for _, cond := range conds {
+			descs = append(descs, describeCondition(cond, redact))
+		}
+		parts = append(parts, op+"("+strings.Join(descs, ", ")+")")
+	}
+	describeAll("all", c.All)
+	describeAll("any", c.Any)
+	if c.Not != nil {
+		parts = append(parts, "not("+describeCondition(*c.Not, redact)+")")
+	}
+	if c.Segment != "" {
+		parts = append(parts, fmt.Sprintf("segment(%s)", c.Segment))
+	}
+	return strings.Join(parts, " and ")
+}
+
+func describeCondition(c cfg.Condition, redact bool) string {
+	var fields []string
+	if c.Field != "" {
+		fields = []string{c.Field}
+	}
+	return describeMatch(fields, c.Values, c.Conditions, redact)
+}
+
+// describeValues describes the operators that are set in m. If redact is set,
+// lists of values are replaced with how many there are, as even patterns like
+// suffixes and regexes can name customers or their emails.
+func describeValues(m cfg.MatchValues, redact bool) string {
+	var parts []string
+	list := func(op string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if redact {
+			parts = append(parts, fmt.Sprintf("%s [%d values]", op, len(values)))
+			return
+		}
+		quoted := make([]string, 0, len(values))
+		for _, v := range values {
+			quoted = append(quoted, strconv.Quote(v))
+		}
+		parts = append(parts, op+" ["+strings.Join(quoted, ", ")+"]")
+	}
+	number := func(op string, n *float64) {
+		if n != nil {
+			parts = append(parts, op+" "+strconv.FormatFloat(*n, 'f', -1, 64))
+		}
+	}
+	version := func(op string, v string) {
+		if v != "" {
+			parts = append(parts, "semver "+op+" "+v)
+		}
+	}
+
+	list("eq", m.Eq)
+	list("neq", m.Neq)
+	list("in", m.In)
+	list("not_in", m.NotIn)
+	list("prefix", m.Prefix)
+	list("suffix", m.Suffix)
+	list("contains", m.Contains)
+	list("regex", m.Regex)
+	number(">", m.Gt)
+	number(">=", m.Gte)
+	number("<", m.Lt)
+	number("<=", m.Lte)
+	if len(m.Between) == 2 {
+		parts = append(parts, fmt.Sprintf("between %s and %s",
+			strconv.FormatFloat(m.Between[0], 'f', -1, 64),
+			strconv.FormatFloat(m.Between[1], 'f', -1, 64)))
+	}
+	version("=", m.Semver.Eq)
+	version(">", m.Semver.Gt)
+	version(">=", m.Semver.Gte)
+	version("<", m.Semver.Lt)
+	version("<=", m.Semver.Lte)
+	if len(m.Semver.Between) == 2 {
+		parts = append(parts, fmt.Sprintf("semver between %s and %s", m.Semver.Between[0], m.Semver.Between[1]))
+	}
+
+	desc := strings.Join(parts, " and ")
+	if m.IgnoreCase {
+		desc += " (ignoring case)"
+	}
+	return desc
+}
+
+// redactedVar replaces the values of redacted vars.
+const redactedVar = "[redacted]"
+
+// redactVars returns vars with their values replaced, keeping their names.
+func redactVars(vars map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(vars))
+	for k := range vars {
+		redacted[k] = redactedVar
+	}
+	return redacted
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,34 @@
+package service
+
+import "fmt"
+
+// UnknownFeatureError is returned when a request asks for a feature that
+// isn't in the config.
+type UnknownFeatureError struct {
+	Feature string
+}
+
+func (e UnknownFeatureError) Error() string {
+	return fmt.Sprintf("unknown feature: '%s'", e.Feature)
+}
+
+// InvalidVarsError is returned when a request has vars that can't be
+// evaluated, e.g. objects or arrays, which rules can't match against.
+type InvalidVarsError struct {
+	Field  string
+	Reason string
+}
+
+func (e InvalidVarsError) Error() string {
+	return fmt.Sprintf("invalid var '%s': %s", e.Field, e.Reason)
+}
+
+// InvalidRequestError is returned when a request is invalid in a way that
+// isn't covered by a more specific error.
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (e InvalidRequestError) Error() string {
+	return "invalid request: " + e.Reason
+}
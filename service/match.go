@@ -0,0 +1,313 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dylannz/feature-service/cfg"
+	"github.com/dylannz/feature-service/semver"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// requestVars are the vars from a request, as decoded from JSON.
+type requestVars map[string]interface{}
+
+// validate checks that the vars the config uses, which are given by used, are
+// strings, numbers, booleans or null, the only types rules can match. Other
+// vars can be anything, so clients can send extra context that no rule uses.
+func (v requestVars) validate(used map[string]bool) error {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		if used[field] {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		switch v[field].(type) {
+		case map[string]interface{}:
+			return InvalidVarsError{Field: field, Reason: "objects aren't supported"}
+		case []interface{}:
+			return InvalidVarsError{Field: field, Reason: "arrays aren't supported"}
+		}
+	}
+	return nil
+}
+
+// str returns the var as a string, which is how it's hashed and compared by
+// the string operators.
+func (v requestVars) str(field string) (string, bool) {
+	val, ok := v[field]
+	if !ok {
+		return "", false
+	}
+	if s, ok := val.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(val), true
+}
+
+// number returns the var as a number, if it is a JSON number or a string
+// containing a number.
+func (v requestVars) number(field string) (float64, bool) {
+	switch t := v[field].(type) {
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// version returns the var as a semantic version, if it is a string containing
+// one.
+func (v requestVars) version(field string) (semver.Version, bool) {
+	s, ok := v[field].(string)
+	if !ok {
+		return semver.Version{}, false
+	}
+	ver, err := semver.Parse(s)
+	return ver, err == nil
+}
+
+// compileRegexps compiles every regex in the config so they don't have to be
+// compiled on each request. The config loader has already rejected invalid
+// regexes, so any that fail to compile here are returned to be logged, and
+// will never match.
+func compileRegexps(config cfg.Config) (map[string]*regexp.Regexp, []error) {
+	regexps := map[string]*regexp.Regexp{}
+	var errs []error
+	config.EachMatchValues(func(path string, m cfg.MatchValues) error {
+		for _, r := range m.Regex {
+			pattern := m.RegexPattern(r)
+			if _, ok := regexps[pattern]; ok {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, path))
+				continue
+			}
+			regexps[pattern] = re
+		}
+		return nil
+	})
+	return regexps, errs
+}
+
+// targeted reports whether the vars match a rule's values and conditions. The
+// values match if the var for any of the rule's fields matches them. If the
+// rule has both values and conditions, both have to match, and if it has
+// neither it never matches.
+func (st *state) targeted(logger logrus.FieldLogger, kind string, fields []string, values cfg.MatchValues, conds cfg.Conditions, vars requestVars) bool {
+	if !hasTargeting(values, conds) {
+		return false
+	}
+
+	if !values.IsZero() {
+		matched := false
+		for _, field := range fields {
+			t := st.matchValues(values, field, vars)
+			logger.Debugf("check: field '%s' in %#v matches %s rules %+v: %t", field, vars, kind, values, t)
+			if t {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if !conds.IsZero() {
+		t := st.matchConditions(conds, vars)
+		logger.Debugf("check: %#v matches %s rule conditions: %t", vars, kind, t)
+		return t
+	}
+	return true
+}
+
+// hasTargeting reports whether a rule has any values or conditions to match.
+func hasTargeting(values cfg.MatchValues, conds cfg.Conditions) bool {
+	return !values.IsZero() || !conds.IsZero()
+}
+
+// matchConditions reports whether all of the conditions that are set are
+// true.
+func (st *state) matchConditions(c cfg.Conditions, vars requestVars) bool {
+	for _, cond := range c.All {
+		if !st.matchCondition(cond, vars) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		matched := false
+		for _, cond := range c.Any {
+			if st.matchCondition(cond, vars) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if c.Not != nil && st.matchCondition(*c.Not, vars) {
+		return false
+	}
+	if c.Segment != "" {
+		// the config loader has already rejected undefined segments, so
+		// any that are missing here never match
+		segment, ok := st.config.Segments[c.Segment]
+		if !ok || !st.matchCondition(segment, vars) {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *state) matchCondition(c cfg.Condition, vars requestVars) bool {
+	if c.Field != "" && !st.matchValues(c.Values, c.Field, vars) {
+		return false
+	}
+	return st.matchConditions(c.Conditions, vars)
+}
+
+// matchValues reports whether the var called field matches m. A var that
+// isn't set never matches.
+func (st *state) matchValues(m cfg.MatchValues, field string, vars requestVars) bool {
+	s, ok := vars.str(field)
+	if !ok || m.IsZero() {
+		return false
+	}
+
+	equal := func(a, b string) bool { return a == b }
+	hasPrefix := strings.HasPrefix
+	hasSuffix := strings.HasSuffix
+	contains := strings.Contains
+	if m.IgnoreCase {
+		equal = strings.EqualFold
+		lower := func(fn func(string, string) bool) func(string, string) bool {
+			return func(a, b string) bool {
+				return fn(strings.ToLower(a), strings.ToLower(b))
+			}
+		}
+		hasPrefix = lower(hasPrefix)
+		hasSuffix = lower(hasSuffix)
+		contains = lower(contains)
+	}
+
+	if len(m.Eq) > 0 && !anyValue(m.Eq, s, equal) {
+		return false
+	}
+	if len(m.In) > 0 && !anyValue(m.In, s, equal) {
+		return false
+	}
+	if anyValue(m.Neq, s, equal) || anyValue(m.NotIn, s, equal) {
+		return false
+	}
+	if len(m.Prefix) > 0 && !anyValue(m.Prefix, s, hasPrefix) {
+		return false
+	}
+	if len(m.Suffix) > 0 && !anyValue(m.Suffix, s, hasSuffix) {
+		return false
+	}
+	if len(m.Contains) > 0 && !anyValue(m.Contains, s, contains) {
+		return false
+	}
+	if len(m.Regex) > 0 && !anyValue(m.Regex, s, func(s, r string) bool {
+		re, ok := st.regexps[m.RegexPattern(r)]
+		return ok && re.MatchString(s)
+	}) {
+		return false
+	}
+	if !matchNumber(m, field, vars) {
+		return false
+	}
+	if !m.Semver.IsZero() && !matchSemver(m.Semver, field, vars) {
+		return false
+	}
+	return true
+}
+
+// matchNumber reports whether the var matches all of the numeric operators
+// that are set.
+func matchNumber(m cfg.MatchValues, field string, vars requestVars) bool {
+	if m.Gt == nil && m.Gte == nil && m.Lt == nil && m.Lte == nil && len(m.Between) == 0 {
+		return true
+	}
+
+	n, ok := vars.number(field)
+	if !ok {
+		return false
+	}
+	if m.Gt != nil && !(n > *m.Gt) {
+		return false
+	}
+	if m.Gte != nil && !(n >= *m.Gte) {
+		return false
+	}
+	if m.Lt != nil && !(n < *m.Lt) {
+		return false
+	}
+	if m.Lte != nil && !(n <= *m.Lte) {
+		return false
+	}
+	if len(m.Between) == 2 && !(n >= m.Between[0] && n <= m.Between[1]) {
+		return false
+	}
+	return true
+}
+
+// matchSemver reports whether the var matches all of the semver operators
+// that are set. The config loader has already rejected invalid versions, so
+// any that fail to parse here never match.
+func matchSemver(m cfg.SemverMatch, field string, vars requestVars) bool {
+	v, ok := vars.version(field)
+	if !ok {
+		return false
+	}
+
+	compare := func(s string, fn func(int) bool) bool {
+		if s == "" {
+			return true
+		}
+		other, err := semver.Parse(s)
+		return err == nil && fn(semver.Compare(v, other))
+	}
+	if !compare(m.Eq, func(c int) bool { return c == 0 }) ||
+		!compare(m.Gt, func(c int) bool { return c > 0 }) ||
+		!compare(m.Gte, func(c int) bool { return c >= 0 }) ||
+		!compare(m.Lt, func(c int) bool { return c < 0 }) ||
+		!compare(m.Lte, func(c int) bool { return c <= 0 }) {
+		return false
+	}
+	if len(m.Between) == 2 &&
+		!(compare(m.Between[0], func(c int) bool { return c >= 0 }) &&
+			compare(m.Between[1], func(c int) bool { return c <= 0 })) {
+		return false
+	}
+	return true
+}
+
+// anyValue reports whether fn(s, v) is true for any of values.
+func anyValue(values []string, s string, fn func(s, v string) bool) bool {
+	for _, v := range values {
+		if fn(s, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,7 +5,12 @@ import (
 	"context"
 	"crypto/md5"
 	"fmt"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dylannz/feature-service/cfg"
 	"github.com/dylannz/feature-service/reqcontext"
@@ -16,36 +21,236 @@ import (
 
 type Service struct {
 	logger logrus.FieldLogger
+	clock  Clock
+
+	mu    sync.RWMutex
+	state *state
+}
+
+// state is everything derived from a single config. It is never modified
+// once built, so requests can keep using the state they started with while
+// SetConfig swaps in a new one.
+type state struct {
 	config cfg.Config
 
 	featureList []string
+	regexps     map[string]*regexp.Regexp
+	locations   map[string]*time.Location
+	// fields are the vars the config matches or hashes
+	fields map[string]bool
 }
 
 func NewService(logger logrus.FieldLogger, config cfg.Config) *Service {
-	// TODO: build cache here
 	svc := &Service{
 		logger: logger,
+		clock:  ClockFunc(time.Now),
+	}
+	svc.SetConfig(config)
+	return svc
+}
+
+// SetConfig atomically replaces the config used to evaluate features.
+// Requests that are already in flight finish using the previous config.
+func (s *Service) SetConfig(config cfg.Config) {
+	st := &state{
 		config: config,
 
 		featureList: make([]string, 0, len(config.Features)),
+		fields:      map[string]bool{},
+	}
+	for _, field := range config.Fields() {
+		st.fields[field] = true
+	}
+
+	var errs []error
+	st.regexps, errs = compileRegexps(config)
+	for _, err := range errs {
+		s.logger.Error(errors.Wrap(err, "compile regex"))
+	}
+	st.locations, errs = loadLocations(config)
+	for _, err := range errs {
+		s.logger.Error(err)
 	}
 
 	for feature := range config.Features {
-		svc.featureList = append(svc.featureList, feature)
+		st.featureList = append(st.featureList, feature)
 	}
-	sort.StringSlice(svc.featureList).Sort()
+	sort.StringSlice(st.featureList).Sort()
 
-	return svc
+	s.mu.Lock()
+	s.state = st
+	s.mu.Unlock()
+}
+
+// SetClock replaces the clock used to evaluate time windows. It isn't safe to
+// call while requests are being served.
+func (s *Service) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+func (s *Service) current() *state {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+func (s *Service) FeaturesStatus(ctx context.Context, req spec.FeaturesRequest, featureName string) (*spec.FeaturesResponse, error) {
+	st := s.current()
+	e := s.newEvaluation(ctx, st, s.clock.Now(), req)
+	if err := e.vars.validate(st.fields); err != nil {
+		return nil, err
+	}
+	if featureName == "" {
+		featureNames, err := st.selectFeatures(req.Features, req.Prefix, req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		return e.featuresStatus(featureNames)
+	}
+	if _, ok := st.config.Features[featureName]; !ok {
+		return nil, UnknownFeatureError{Feature: featureName}
+	}
+	return e.featuresStatus([]string{featureName})
+}
+
+// FeaturesStatusBatch evaluates features for each of the request's items, all
+// with the same config. Items with invalid vars get an error in their result,
+// rather than failing the whole batch.
+func (s *Service) FeaturesStatusBatch(ctx context.Context, req spec.BatchRequest) (*spec.BatchResponse, error) {
+	st := s.current()
+	now := s.clock.Now()
+
+	featureNames, err := st.selectFeatures(req.Features, req.Prefix, req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	res := spec.NewBatchResponse()
+	if req.IncludeDisabled != nil && *req.IncludeDisabled {
+		res.SetConfigVersion(st.config.Revision)
+	}
+	for i, item := range req.Items {
+		key := strconv.Itoa(i)
+		if item.Key != nil {
+			key = *item.Key
+		}
+		if _, ok := (*res.Results)[key]; ok {
+			return nil, InvalidRequestError{Reason: fmt.Sprintf("duplicate key '%s'", key)}
+		}
+
+		e := s.newEvaluation(ctx, st, now, spec.FeaturesRequest{
+			Vars:            item.Vars,
+			Explain:         req.Explain,
+			IncludeDisabled: req.IncludeDisabled,
+		})
+		if err := e.vars.validate(st.fields); err != nil {
+			res.AddError(key, spec.ErrorCodeInvalidVars, err.Error())
+			continue
+		}
+		r, err := e.featuresStatus(featureNames)
+		if err != nil {
+			return nil, errors.Wrapf(err, "item '%s'", key)
+		}
+		res.AddResult(key, r.Features)
+	}
+	return res, nil
 }
 
-func (s Service) FeaturesStatus(ctx context.Context, req spec.FeaturesRequest, featureName string) (*spec.FeaturesResponse, error) {
-	if featureName != "" {
-		return s.featureStatus(ctx, req, featureName)
+// selectFeatures returns the names of the features selected by a request:
+// the named features, or every feature if there aren't any, limited to those
+// with the prefix and any of the tags if they're set.
+func (st *state) selectFeatures(names *[]string, prefix *string, tags *[]string) ([]string, error) {
+	featureNames := st.featureList
+	if names != nil && len(*names) > 0 {
+		featureNames = *names
+		for _, name := range featureNames {
+			if _, ok := st.config.Features[name]; !ok {
+				return nil, UnknownFeatureError{Feature: name}
+			}
+		}
+	}
+	if (prefix == nil || *prefix == "") && (tags == nil || len(*tags) == 0) {
+		return featureNames, nil
 	}
 
+	selected := make([]string, 0, len(featureNames))
+	for _, name := range featureNames {
+		if prefix != nil && !strings.HasPrefix(name, *prefix) {
+			continue
+		}
+		if tags != nil && len(*tags) > 0 && !hasAnyTag(st.config.Features[name], *tags) {
+			continue
+		}
+		selected = append(selected, name)
+	}
+	return selected, nil
+}
+
+func hasAnyTag(feature cfg.Feature, tags []string) bool {
+	for _, tag := range tags {
+		if feature.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluation evaluates features for a single request. It remembers the status
+// of each feature it has evaluated, so features that are required by several
+// others are only evaluated once.
+type evaluation struct {
+	logger logrus.FieldLogger
+	st     *state
+	now    time.Time
+	vars   requestVars
+	// explain adds an explanation to each feature's status
+	explain bool
+	// includeDisabled adds disabled features to the response
+	includeDisabled bool
+	// snapshot adds the config version to the response, as well as disabled
+	// features
+	snapshot bool
+
+	results map[string]*spec.FeaturesResponse
+	// evaluating holds the features whose prerequisites are being evaluated,
+	// to guard against cycles
+	evaluating map[string]bool
+}
+
+func (s *Service) newEvaluation(ctx context.Context, st *state, now time.Time, req spec.FeaturesRequest) *evaluation {
+	vars := requestVars{}
+	if req.Vars != nil {
+		vars = *req.Vars
+	}
+	explain := req.Explain != nil && *req.Explain
+	snapshot := req.IncludeDisabled != nil && *req.IncludeDisabled
+	return &evaluation{
+		logger: s.logger.WithFields(logrus.Fields{
+			"request_id": reqcontext.RequestIDFromContext(ctx),
+		}),
+		st:   st,
+		now:  now,
+		vars: vars,
+
+		explain:         explain,
+		includeDisabled: explain || snapshot,
+		snapshot:        snapshot,
+
+		results:    map[string]*spec.FeaturesResponse{},
+		evaluating: map[string]bool{},
+	}
+}
+
+// featuresStatus returns the status of each of the named features.
+func (e *evaluation) featuresStatus(featureNames []string) (*spec.FeaturesResponse, error) {
 	res := spec.NewFeaturesResponse()
-	for _, fn := range s.featureList {
-		r, err := s.featureStatus(ctx, req, fn)
+	// a complete snapshot includes the config version, so clients can tell
+	// when it changes
+	if e.snapshot {
+		res.SetConfigVersion(e.st.config.Revision)
+	}
+	for _, fn := range featureNames {
+		r, err := e.featureStatus(fn)
 		if err != nil {
 			return res, err
 		}
@@ -60,63 +265,247 @@ func (s Service) FeaturesStatus(ctx context.Context, req spec.FeaturesRequest, f
 	return res, nil
 }
 
-func (s Service) featureStatus(ctx context.Context, req spec.FeaturesRequest, featureName string) (*spec.FeaturesResponse, error) {
-	logger := s.logger.WithFields(logrus.Fields{
-		"request_id": reqcontext.RequestIDFromContext(ctx),
-	})
+func (e *evaluation) featureStatus(featureName string) (*spec.FeaturesResponse, error) {
+	if res, ok := e.results[featureName]; ok {
+		return res, nil
+	}
+	res, err := e.evaluate(featureName)
+	if err != nil {
+		return res, err
+	}
+	e.results[featureName] = res
+	return res, nil
+}
+
+// failedPrerequisite returns the first feature the feature requires that
+// isn't enabled, or doesn't have the required variant. It returns an empty
+// string if every prerequisite is met.
+func (e *evaluation) failedPrerequisite(featureName string, feature cfg.Feature) (string, error) {
+	if len(feature.Requires) == 0 {
+		return "", nil
+	}
+	if e.evaluating[featureName] {
+		// the config loader rejects cycles, so this shouldn't happen
+		e.logger.Errorf("feature '%s' requires itself", featureName)
+		return featureName, nil
+	}
+	e.evaluating[featureName] = true
+	defer delete(e.evaluating, featureName)
+
+	for _, req := range feature.Requires {
+		r, err := e.featureStatus(req.Feature)
+		if err != nil {
+			return "", errors.Wrapf(err, "feature '%s' requires '%s'", featureName, req.Feature)
+		}
+		status, ok := (*r.Features)[req.Feature]
+		if !ok || status.Enabled == nil || !*status.Enabled {
+			e.logger.Debugf("match: required feature '%s' is disabled", req.Feature)
+			return req.Feature, nil
+		}
+		if req.Variant != "" && (status.Variant == nil || *status.Variant != req.Variant) {
+			e.logger.Debugf("match: required feature '%s' doesn't have variant '%s'", req.Feature, req.Variant)
+			return req.Feature, nil
+		}
+	}
+	return "", nil
+}
+
+func (e *evaluation) evaluate(featureName string) (*spec.FeaturesResponse, error) {
+	logger, st, now, vars := e.logger, e.st, e.now, e.vars
 	res := spec.NewFeaturesResponse()
 
-	feature, ok := s.config.Features[featureName]
+	feature, ok := st.config.Features[featureName]
 	if !ok {
-		return res, errors.Errorf("unknown feature: '%s'", featureName)
+		return res, UnknownFeatureError{Feature: featureName}
 	}
 
-	vars := map[string]string{}
-	if req.Vars != nil {
-		for k, v := range *req.Vars {
-			switch t := v.(type) {
-			case string:
-				vars[k] = t
-			default:
-				vars[k] = fmt.Sprint(v)
-			}
+	// explained adds the explanation to res if the request asked for one,
+	// and the feature's status if it's disabled and the request asked for
+	// disabled features
+	explained := func(x *spec.Explanation) (*spec.FeaturesResponse, error) {
+		if _, ok := (*res.Features)[featureName]; !ok && e.includeDisabled {
+			res.AddStatus(featureName, false, nil)
 		}
+		if e.explain {
+			res.SetExplanation(featureName, x)
+		}
+		return res, nil
+	}
+
+	if !st.windowActive(feature.Window, now) {
+		logger.Debug("match: feature is outside its time window")
+		return explained(spec.NewExplanation(spec.ReasonOutOfSchedule))
+	}
+
+	failed, err := e.failedPrerequisite(featureName, feature)
+	if err != nil {
+		return res, err
+	}
+	if failed != "" {
+		return explained(spec.NewExplanation(spec.ReasonPrerequisiteFailed).WithPrerequisite(failed))
 	}
 
 	// first we deal with disable rules
-	if foreachDisableField(feature.Rules.Disable, func(field string, rule cfg.DisableRule) bool {
-		t := varInSlice(rule.Values.Eq, field, vars)
-		logger.Debugf("check: field '%s' in %#v matches disable rules %#v: %t", field, req.Vars, rule.Values.Eq, t)
-		return t
-	}) {
-		logger.Debug("match: matched values.eq rule")
-		return res, nil
+	for i, rule := range feature.Rules.Disable {
+		// rules outside their time window are ignored
+		if !st.windowActive(rule.Window, now) {
+			continue
+		}
+		if st.targeted(logger, "disable", ruleFields(rule.Field, rule.Fields), rule.Values, rule.Conditions, vars) {
+			logger.Debug("match: matched disable rule")
+			return explained(spec.NewExplanation(spec.ReasonDisableMatch).WithRule(i, rule.ID))
+		}
+	}
+
+	salt := featureSalt(featureName, feature)
+	// ruleErr explains the first rule that couldn't be evaluated, if no
+	// other rule matches
+	var ruleErr *spec.Explanation
+	checkWeight := func(i int, rule cfg.EnableRule, weight int) {
+		if (weight < 0 || weight > 100) && ruleErr == nil {
+			ruleErr = spec.NewExplanation(spec.ReasonError).
+				WithRule(i, rule.ID).
+				WithError(errors.Errorf("weight (%d) outside range 0-100", weight))
+		}
 	}
 
 	// now we deal with enable rules
-	if foreachEnableField(feature.Rules.Enable, func(field string, rule cfg.EnableRule) bool {
-		t := varInSlice(rule.Values.Eq, field, vars)
-		logger.Debugf("check: field '%s' in %#v matches enable rules %#v: %t", field, req.Vars, rule.Values.Eq, t)
-		return t
-	}) {
-		logger.Debug("match: matched values.eq rule")
-		res.AddStatus(featureName, true, setVars(logger, feature.Rules.SetVars, vars))
-		return res, nil
+	for i, rule := range feature.Rules.Enable {
+		if !st.windowActive(rule.Window, now) {
+			continue
+		}
+		fields := ruleFields(rule.Field, rule.Fields)
+		if rule.Mode == cfg.RuleModeAnd {
+			weight := rampWeight(rule, now)
+			weighted := rule.Weight != nil || rule.Ramp != nil
+			checkWeight(i, rule, weight)
+			if st.targetedAnd(logger, "enable", salt, fields, rule.Values, rule.Conditions, weight, weighted, rule.Ramp != nil, vars) {
+				logger.Debug("match: matched enable rule and its weight")
+				st.addEnabled(logger, res, featureName, feature, salt, rule, vars)
+				x := spec.NewExplanation(spec.ReasonTargetingMatch)
+				if weighted {
+					x = spec.NewExplanation(spec.ReasonSplit).WithWeight(bucket(logger, salt, fields, vars), weight)
+				}
+				return explained(x.WithRule(i, rule.ID))
+			}
+			continue
+		}
+		if st.targeted(logger, "enable", fields, rule.Values, rule.Conditions, vars) {
+			logger.Debug("match: matched enable rule")
+			st.addEnabled(logger, res, featureName, feature, salt, rule, vars)
+			return explained(spec.NewExplanation(spec.ReasonTargetingMatch).WithRule(i, rule.ID))
+		}
 	}
 
 	// now we deal with weight rules
-	for _, rule := range feature.Rules.Enable {
-		if ruleWeight(logger, ruleFields(rule.Field, rule.Fields), rule.Weight, vars) {
+	for i, rule := range feature.Rules.Enable {
+		if !st.windowActive(rule.Window, now) || rule.Mode == cfg.RuleModeAnd {
+			continue
+		}
+		fields := ruleFields(rule.Field, rule.Fields)
+		weight := rampWeight(rule, now)
+		checkWeight(i, rule, weight)
+		if ruleWeight(logger, salt, fields, weight, rule.Ramp != nil, vars) {
 			logger.Debug("match: matched weight rule")
-			res.AddStatus(featureName, true, setVars(logger, feature.Rules.SetVars, vars))
-			return res, nil
+			st.addEnabled(logger, res, featureName, feature, salt, rule, vars)
+			return explained(spec.NewExplanation(spec.ReasonSplit).WithRule(i, rule.ID).
+				WithWeight(bucket(logger, salt, fields, vars), weight))
 		}
 	}
 
-	return res, nil
+	if ruleErr != nil {
+		return explained(ruleErr)
+	}
+	return explained(spec.NewExplanation(spec.ReasonDefault))
+}
+
+// featureSalt returns the salt to mix into the hash for the feature's weighted
+// rules, or an empty string if the feature uses legacy bucketing, which
+// features from version 1 files without a bucketing do.
+func featureSalt(featureName string, feature cfg.Feature) string {
+	if feature.Bucketing != cfg.BucketingSalted {
+		return ""
+	}
+	if feature.Salt != "" {
+		return feature.Salt
+	}
+	return featureName
+}
+
+// variantSalt returns the salt to mix into the hash that picks the feature's
+// variant. Unlike featureSalt it's never empty, even with legacy bucketing, so
+// features with the same allocation don't give users the same variants.
+func variantSalt(featureName string, feature cfg.Feature) string {
+	if feature.Salt != "" {
+		return feature.Salt
+	}
+	return featureName
+}
+
+// addEnabled adds the feature to res as enabled, along with its variant and
+// vars. rule is the enable rule that enabled the feature.
+func (st *state) addEnabled(logger logrus.FieldLogger, res *spec.FeaturesResponse, featureName string, feature cfg.Feature, salt string, rule cfg.EnableRule, vars requestVars) {
+	variant := rule.Variant
+	if variant != "" {
+		logger.Debugf("match: rule forces variant '%s'", variant)
+	} else {
+		variant = pickVariant(logger, variantSalt(featureName, feature), feature.Variants, ruleFields(rule.Field, rule.Fields), vars)
+	}
+
+	v := map[string]interface{}{}
+	for _, a := range feature.Variants.Allocation {
+		if a.Name == variant {
+			for k, val := range a.Payload {
+				v[k] = val
+			}
+		}
+	}
+	for k, val := range st.setVars(logger, salt, feature.Rules.SetVars, vars) {
+		v[k] = val
+	}
+
+	res.AddStatus(featureName, true, v)
+	if variant != "" {
+		res.SetVariant(featureName, variant)
+	}
+}
+
+// pickVariant deterministically picks one of the feature's variants based on
+// the values of the variant fields, falling back to the fields of the enable
+// rule that matched. It returns an empty string if there are no variants.
+func pickVariant(logger logrus.FieldLogger, salt string, variants cfg.Variants, fields []string, vars requestVars) string {
+	total := 0
+	for _, v := range variants.Allocation {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	if f := ruleFields(variants.Field, variants.Fields); len(f) > 0 {
+		fields = f
+	}
+
+	// Use the second half of the hash so the variant is independent of the
+	// first half, which decided whether the feature is enabled at all.
+	h := hashFields(logger, salt, fields, vars)
+	c := int(hashNumber(h[8:]) % uint64(total))
+	for _, v := range variants.Allocation {
+		if v.Weight <= 0 {
+			continue
+		}
+		if c < v.Weight {
+			logger.Debugf("match: picked variant '%s'", v.Name)
+			return v.Name
+		}
+		c -= v.Weight
+	}
+	return ""
 }
 
-func setVars(logger logrus.FieldLogger, rules []cfg.SetVarRule, vars map[string]string) map[string]interface{} {
+func (st *state) setVars(logger logrus.FieldLogger, salt string, rules []cfg.SetVarRule, vars requestVars) map[string]interface{} {
 	if len(rules) == 0 {
 		logger.Debug("no set_vars rules")
 		return nil
@@ -126,18 +515,26 @@ func setVars(logger logrus.FieldLogger, rules []cfg.SetVarRule, vars map[string]
 
 	// now we deal with enable rules
 	setVars := map[string]interface{}{}
-	foreachSetVarField(rules, func(field string, rule cfg.SetVarRule) {
-		t := varInSlice(rule.Values.Eq, field, vars)
-		logger.Debugf("check: field '%s' in %#v matches set var rules %#v: %t", field, vars, rule.Values.Eq, t)
-		if t {
+	for _, rule := range rules {
+		fields := ruleFields(rule.Field, rule.Fields)
+		var matched bool
+		if rule.Mode == cfg.RuleModeAnd {
+			matched = st.targetedAnd(logger, "set var", salt, fields, rule.Values, rule.Conditions, rule.WeightOrZero(), rule.Weight != nil, false, vars)
+		} else {
+			matched = st.targeted(logger, "set var", fields, rule.Values, rule.Conditions, vars)
+		}
+		if matched {
 			for k, v := range rule.Set {
 				setVars[k] = v
 			}
 		}
-	})
+	}
 
 	for _, rule := range rules {
-		if ruleWeight(logger, ruleFields(rule.Field, rule.Fields), rule.Weight, vars) {
+		if rule.Mode == cfg.RuleModeAnd {
+			continue
+		}
+		if ruleWeight(logger, salt, ruleFields(rule.Field, rule.Fields), rule.WeightOrZero(), false, vars) {
 			for k, v := range rule.Set {
 				setVars[k] = v
 			}
@@ -149,6 +546,22 @@ func setVars(logger logrus.FieldLogger, rules []cfg.SetVarRule, vars map[string]
 	return setVars
 }
 
+// targetedAnd reports whether the vars match a rule in 'and' mode: they have
+// to match the rule's values and conditions, and then fall within its weight.
+// A rule without values or conditions applies its weight to everyone, and one
+// that isn't weighted (it has no weight or ramp) applies to everyone it
+// matches. A weight of 0 applies to no one. ramped is set if the weight comes
+// from a ramp (see ruleWeight).
+func (st *state) targetedAnd(logger logrus.FieldLogger, kind string, salt string, fields []string, values cfg.MatchValues, conds cfg.Conditions, weight int, weighted, ramped bool, vars requestVars) bool {
+	if hasTargeting(values, conds) && !st.targeted(logger, kind, fields, values, conds, vars) {
+		return false
+	}
+	if !weighted {
+		return true
+	}
+	return ruleWeight(logger, salt, fields, weight, ramped, vars)
+}
+
 func ruleFields(field string, fields []string) []string {
 	if field != "" {
 		return []string{field}
@@ -156,80 +569,69 @@ func ruleFields(field string, fields []string) []string {
 	return fields
 }
 
-func ruleWeight(logger logrus.FieldLogger, fields []string, weight int, vars map[string]string) bool {
+// ruleWeight reports whether the vars fall within a rule's weight. ramped is
+// set if the weight comes from a ramp, which always covers the buckets at or
+// below it, so a ramp that reaches 100 enables everyone even with legacy
+// bucketing.
+func ruleWeight(logger logrus.FieldLogger, salt string, fields []string, weight int, ramped bool, vars requestVars) bool {
 	if weight < 0 || weight > 100 {
 		logger.Debugf("weight (%d) outside range 0-100", weight)
 		return false
 	}
 
-	// first build a string containing all the key/value pairs
+	// See if the bucket is within the defined weight, so a weight of 100
+	// covers every bucket. And there we have it - a deterministic way to
+	// calculate whether a feature should be enabled based on an an arbitrary
+	// list of key/value pairs.
+	c := bucket(logger, salt, fields, vars)
+	if salt == "" && !ramped {
+		// Legacy bucketing (the only kind without a salt) keeps comparing
+		// with less than, so existing rollouts don't grow by a bucket.
+		// Ramps are newer than salting, so they have no such rollouts.
+		t := c < weight
+		logger.Debugf("check: hash result < weight (%d < %d): %t", c, weight, t)
+		return t
+	}
+	t := c <= weight
+	logger.Debugf("check: hash result <= weight (%d <= %d): %t", c, weight, t)
+	return t
+}
+
+// bucket hashes the fields as md5, converts the first half of the hash to a
+// number, then returns it modulo 100, plus 1.
+func bucket(logger logrus.FieldLogger, salt string, fields []string, vars requestVars) int {
+	h := hashFields(logger, salt, fields, vars)
+	return int(hashNumber(h[:8])%100) + 1 // we need a number from 1-100 (inclusive)
+}
+
+// hashFields returns the md5 hash of the salt and the key/value pairs for the
+// given fields.
+func hashFields(logger logrus.FieldLogger, salt string, fields []string, vars requestVars) [md5.Size]byte {
+	// first build a string containing the salt and all the key/value pairs
 	b := bytes.Buffer{}
+	if salt != "" {
+		logger.Debugf("using salt: %s", salt)
+		b.WriteString(salt)
+		b.WriteString(";")
+	}
 	logger.Debugf("using keys/values from fields: %#v", fields)
 	for _, field := range fields {
 		b.WriteString(field)
 		b.WriteString("=")
-		if s, ok := vars[field]; ok {
+		if s, ok := vars.str(field); ok {
 			b.WriteString(s)
 		}
 		b.WriteString(";")
 	}
+	return md5.Sum(b.Bytes())
+}
 
-	// Hash as md5, convert the first half of the hash to a number,
-	// then modulo 100 and see if it's less than the defined weight.
-	// And there we have it - a deterministic way to calculate whether
-	// a feature should be enabled based on an an arbitrary list of
-	// key/value pairs.
-	h := md5.Sum(b.Bytes())
+// hashNumber converts up to 8 bytes of a hash to a number.
+func hashNumber(h []byte) uint64 {
 	var n uint64
-	for i := 0; i < 8; i++ {
+	for i := 0; i < len(h) && i < 8; i++ {
 		n <<= 8
 		n |= uint64(uint8(h[i]))
 	}
-	c := int(n%100) + 1 // we need a number from 1-100 (inclusive)
-	t := c < weight
-	logger.Debugf("check: hash result < weight (%d < %d): %t", c, weight, t)
-	return t
-}
-
-func foreachDisableField(rules []cfg.DisableRule, fn func(string, cfg.DisableRule) bool) bool {
-	for _, rule := range rules {
-		for _, field := range ruleFields(rule.Field, rule.Fields) {
-			if fn(field, rule) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func foreachEnableField(rules []cfg.EnableRule, fn func(string, cfg.EnableRule) bool) bool {
-	for _, rule := range rules {
-		for _, field := range ruleFields(rule.Field, rule.Fields) {
-			if fn(field, rule) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func foreachSetVarField(rules []cfg.SetVarRule, fn func(string, cfg.SetVarRule)) bool {
-	for _, rule := range rules {
-		for _, field := range ruleFields(rule.Field, rule.Fields) {
-			fn(field, rule)
-		}
-	}
-	return false
-}
-
-func varInSlice(a []string, field string, vars map[string]string) bool {
-	s, ok := vars[field]
-	if ok {
-		for _, v := range a {
-			if v == s {
-				return true
-			}
-		}
-	}
-	return false
+	return n
 }
@@ -1,7 +1,11 @@
 package service_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"strconv"
+	"time"
 
 	"github.com/dylannz/feature-service/cfg"
 	. "github.com/dylannz/feature-service/service"
@@ -9,9 +13,26 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+func weight(w int) *int {
+	return &w
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func timestamp(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
 var _ = Describe("service", func() {
 	cfgProfile := func() cfg.Config {
 		return cfg.Config{
@@ -22,7 +43,7 @@ var _ = Describe("service", func() {
 						Enable: []cfg.EnableRule{
 							{
 								Fields: []string{"email", "customer_id"},
-								Weight: 10,
+								Weight: weight(10),
 							},
 						},
 					},
@@ -108,7 +129,7 @@ var _ = Describe("service", func() {
 						Enable: []cfg.EnableRule{
 							{
 								Field:  "customer_id",
-								Weight: 50,
+								Weight: weight(50),
 							},
 						},
 					},
@@ -158,6 +179,46 @@ var _ = Describe("service", func() {
 		}
 	}
 
+	cfgVariants := func() cfg.Config {
+		return cfg.Config{
+			Version: "1.0",
+			Features: map[string]cfg.Feature{
+				"checkout": {
+					Variants: cfg.Variants{
+						Allocation: []cfg.Variant{
+							{Name: "control", Weight: 50},
+							{
+								Name:    "treatment",
+								Weight:  50,
+								Payload: map[string]interface{}{"button_colour": "green"},
+							},
+						},
+					},
+					Rules: cfg.Rules{
+						Enable: []cfg.EnableRule{
+							{
+								Field:   "customer_id",
+								Values:  cfg.MatchValues{Eq: []string{"123"}},
+								Variant: "treatment",
+							},
+							{
+								Field:  "customer_id",
+								Weight: weight(100),
+							},
+						},
+						SetVars: []cfg.SetVarRule{
+							{
+								Field:  "customer_id",
+								Values: cfg.MatchValues{Eq: []string{"123"}},
+								Set:    map[string]interface{}{"int_key": 1},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
 	newFeaturesRequest := func(vars map[string]interface{}) spec.FeaturesRequest {
 		return spec.FeaturesRequest{
 			Vars: &vars,
@@ -249,6 +310,22 @@ var _ = Describe("service", func() {
 			nil,
 			"unknown feature: 'stripe_billing'",
 		),
+		Entry(
+			"when a var is an object it returns an error",
+			cfgCombined(),
+			newFeaturesRequest(map[string]interface{}{"customer_id": map[string]interface{}{"id": "1"}}),
+			"",
+			nil,
+			"invalid var 'customer_id': objects aren't supported",
+		),
+		Entry(
+			"when a var is an array it returns an error",
+			cfgCombined(),
+			newFeaturesRequest(map[string]interface{}{"customer_id": []interface{}{"1", "2"}}),
+			"",
+			nil,
+			"invalid var 'customer_id': arrays aren't supported",
+		),
 		Entry(
 			"vars are returned when they have been configured",
 			cfgSetVars(),
@@ -265,6 +342,33 @@ var _ = Describe("service", func() {
 				),
 			"",
 		),
+		Entry(
+			"a rule can force a variant, and the variant payload is merged with set_vars",
+			cfgVariants(),
+			newFeaturesRequest(map[string]interface{}{"customer_id": "123"}),
+			"checkout",
+			spec.NewFeaturesResponse().
+				AddStatus(
+					"checkout",
+					true,
+					map[string]interface{}{
+						"button_colour": "green",
+						"int_key":       1,
+					},
+				).
+				SetVariant("checkout", "treatment"),
+			"",
+		),
+		Entry(
+			"a variant is picked by weight when the rule doesn't force one",
+			cfgVariants(),
+			newFeaturesRequest(map[string]interface{}{"customer_id": "2"}),
+			"checkout",
+			spec.NewFeaturesResponse().
+				AddStatus("checkout", true, nil).
+				SetVariant("checkout", "control"),
+			"",
+		),
 		Entry(
 			"vars are not returned when they don't meet the set_vars rules",
 			cfgSetVars(),
@@ -274,4 +378,1201 @@ var _ = Describe("service", func() {
 			"",
 		),
 	)
+
+	Describe("SetConfig", func() {
+		It("replaces the config used for subsequent requests", func() {
+			logger := logrus.WithField("service", "test")
+			svc := NewService(logger, cfgStripeInclude())
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": "123"})
+
+			res, err := svc.FeaturesStatus(context.Background(), req, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(spec.NewFeaturesResponse().AddStatus("stripe_billing", true, nil)))
+
+			svc.SetConfig(cfgStripeIncludeAndExclude())
+			res, err = svc.FeaturesStatus(context.Background(), req, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(spec.NewFeaturesResponse()))
+
+			svc.SetConfig(cfg.Config{})
+			_, err = svc.FeaturesStatus(context.Background(), req, "stripe_billing")
+			Expect(err).To(MatchError(ContainSubstring("unknown feature")))
+		})
+	})
+
+	Describe("errors", func() {
+		It("returns an UnknownFeatureError for features that aren't in the config", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgCombined())
+			_, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(nil), "checkout_v3")
+			Expect(err).To(Equal(UnknownFeatureError{Feature: "checkout_v3"}))
+		})
+
+		It("returns an InvalidVarsError for vars that can't be evaluated", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgCombined())
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": map[string]interface{}{"id": "1"}})
+			_, err := svc.FeaturesStatus(context.Background(), req, "stripe_billing")
+			Expect(err).To(Equal(InvalidVarsError{Field: "customer_id", Reason: "objects aren't supported"}))
+		})
+
+		It("accepts vars of any type that the config doesn't use", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgCombined())
+			req := newFeaturesRequest(map[string]interface{}{
+				"customer_id": "123",
+				"customer":    map[string]interface{}{"id": "1"},
+				"roles":       []interface{}{"admin"},
+			})
+			_, err := svc.FeaturesStatus(context.Background(), req, "stripe_billing")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	DescribeTable(
+		"selecting features",
+		func(features []string, prefix string, tags []string, expected []string, expectedErr error) {
+			always := []cfg.EnableRule{{Field: "customer_id", Values: cfg.MatchValues{Eq: []string{"1"}}}}
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"billing.invoices": {Tags: []string{"web"}, Rules: cfg.Rules{Enable: always}},
+					"billing.stripe":   {Tags: []string{"web", "mobile"}, Rules: cfg.Rules{Enable: always}},
+					"search_v2":        {Tags: []string{"mobile"}, Rules: cfg.Rules{Enable: always}},
+					"profile_page_v2":  {Rules: cfg.Rules{Enable: always}},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": "1"})
+			req.Features = &features
+			req.Prefix = &prefix
+			req.Tags = &tags
+			res, err := svc.FeaturesStatus(context.Background(), req, "")
+			if expectedErr != nil {
+				Expect(err).To(Equal(expectedErr))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			names := []string{}
+			for name := range *res.Features {
+				names = append(names, name)
+			}
+			Expect(names).To(ConsistOf(expected))
+		},
+		Entry("every feature", nil, "", nil,
+			[]string{"billing.invoices", "billing.stripe", "search_v2", "profile_page_v2"}, nil),
+		Entry("named features", []string{"search_v2", "profile_page_v2"}, "", nil,
+			[]string{"search_v2", "profile_page_v2"}, nil),
+		Entry("prefix", nil, "billing.", nil,
+			[]string{"billing.invoices", "billing.stripe"}, nil),
+		Entry("tags", nil, "", []string{"mobile"},
+			[]string{"billing.stripe", "search_v2"}, nil),
+		Entry("every filter has to match", []string{"billing.stripe", "search_v2", "profile_page_v2"}, "billing.", []string{"mobile"},
+			[]string{"billing.stripe"}, nil),
+		Entry("unknown named feature", []string{"checkout_v3"}, "", nil,
+			nil, UnknownFeatureError{Feature: "checkout_v3"}),
+	)
+
+	Describe("FeaturesStatusBatch", func() {
+		key := func(k string) *string {
+			return &k
+		}
+		item := func(k *string, vars map[string]interface{}) spec.BatchItem {
+			return spec.BatchItem{Key: k, Vars: &vars}
+		}
+
+		It("evaluates features for each item, keyed by the item's key or index", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgStripeInclude())
+			res, err := svc.FeaturesStatusBatch(context.Background(), spec.BatchRequest{
+				Items: []spec.BatchItem{
+					item(key("a"), map[string]interface{}{"customer_id": "123"}),
+					item(nil, map[string]interface{}{"customer_id": "321"}),
+					item(key("c"), map[string]interface{}{"customer_id": map[string]interface{}{"id": "123"}}),
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(spec.NewBatchResponse().
+				AddResult("a", spec.NewFeaturesResponse().AddStatus("stripe_billing", true, nil).Features).
+				AddResult("1", spec.NewFeaturesResponse().Features).
+				AddError("c", spec.ErrorCodeInvalidVars, "invalid var 'customer_id': objects aren't supported"),
+			))
+		})
+
+		It("only evaluates the requested features", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgCombined())
+			features := []string{"stripe_billing"}
+			includeDisabled := true
+			res, err := svc.FeaturesStatusBatch(context.Background(), spec.BatchRequest{
+				Features:        &features,
+				IncludeDisabled: &includeDisabled,
+				Items:           []spec.BatchItem{item(nil, map[string]interface{}{"customer_id": "2"})},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect((*res.Results)["0"].Features).To(Equal(
+				spec.NewFeaturesResponse().AddStatus("stripe_billing", true, nil).Features,
+			))
+		})
+
+		It("returns an error for unknown features and duplicate keys", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgCombined())
+			features := []string{"checkout_v3"}
+			_, err := svc.FeaturesStatusBatch(context.Background(), spec.BatchRequest{Features: &features})
+			Expect(err).To(Equal(UnknownFeatureError{Feature: "checkout_v3"}))
+
+			_, err = svc.FeaturesStatusBatch(context.Background(), spec.BatchRequest{
+				Items: []spec.BatchItem{item(key("a"), nil), item(key("a"), nil)},
+			})
+			Expect(err).To(Equal(InvalidRequestError{Reason: "duplicate key 'a'"}))
+		})
+	})
+
+	Describe("Catalog", func() {
+		createdAt := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+		expiresAt := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+		config := cfg.Config{
+			Version: "1.0",
+			Features: map[string]cfg.Feature{
+				"checkout_v3": {
+					Description: "The new one page checkout",
+					Owner:       "team-payments",
+					Tags:        []string{"checkout"},
+					CreatedAt:   &createdAt,
+					ExpiresAt:   &expiresAt,
+				},
+				"search_v2": {},
+			},
+			Revision: "abc123",
+		}
+
+		It("lists every feature with its metadata", func() {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			svc.SetClock(ClockFunc(func() time.Time { return time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC) }))
+			res, err := svc.Catalog(context.Background(), false)
+			Expect(err).NotTo(HaveOccurred())
+
+			description, owner, tags, expired := "The new one page checkout", "team-payments", []string{"checkout"}, false
+			Expect(*res.ConfigVersion).To(Equal("abc123"))
+			Expect(*res.Features).To(Equal(map[string]spec.FeatureInfo{
+				"checkout_v3": {
+					Description: &description,
+					Owner:       &owner,
+					Tags:        &tags,
+					CreatedAt:   &createdAt,
+					ExpiresAt:   &expiresAt,
+					Expired:     &expired,
+					Rules:       &spec.RuleSummaries{},
+				},
+				"search_v2": {Expired: &expired, Rules: &spec.RuleSummaries{}},
+			}))
+		})
+
+		It("redacts every list of values", func() {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"checkout_v3": {Rules: cfg.Rules{
+						Enable: []cfg.EnableRule{{Field: "email", Values: cfg.MatchValues{
+							Prefix:   []string{"alex."},
+							Suffix:   []string{"@customer.com"},
+							Contains: []string{"sam"},
+							Regex:    []string{`^jo(e|sh)@example\.com$`},
+						}}},
+						Disable: []cfg.DisableRule{{Conditions: cfg.Conditions{Any: []cfg.Condition{
+							{Field: "email", Values: cfg.MatchValues{Eq: []string{"kim@example.com"}}},
+						}}}},
+					}},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			res, err := svc.Catalog(context.Background(), true)
+			Expect(err).NotTo(HaveOccurred())
+			b, err := json.Marshal(res)
+			Expect(err).NotTo(HaveOccurred())
+			for _, literal := range []string{"alex.", "@customer.com", "sam", "jo(e|sh)", "kim@example.com"} {
+				Expect(string(b)).NotTo(ContainSubstring(literal))
+			}
+			Expect(*(*(*res.Features)["checkout_v3"].Rules.Enable)[0].Match).To(Equal(
+				`email prefix [1 values] and suffix [1 values] and contains [1 values] and regex [1 values]`,
+			))
+		})
+
+		It("returns a single feature with its rules", func() {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"checkout_v3": {
+						Sources:  []string{"checkout.yml"},
+						Requires: []cfg.Prerequisite{{Feature: "payments_v2", Variant: "treatment"}},
+						Variants: cfg.Variants{Allocation: []cfg.Variant{{Name: "control", Weight: 1}}},
+						Rules: cfg.Rules{
+							Enable: []cfg.EnableRule{
+								{
+									ID:     "beta",
+									Fields: []string{"customer_id", "email"},
+									Values: cfg.MatchValues{In: []string{"123", "456"}},
+									Conditions: cfg.Conditions{
+										All: []cfg.Condition{
+											{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}, IgnoreCase: true}},
+											{Field: "app_version", Values: cfg.MatchValues{Semver: cfg.SemverMatch{Gte: "4.2.0"}}},
+										},
+										Not: &cfg.Condition{Conditions: cfg.Conditions{Segment: "staff"}},
+									},
+									Variant: "control",
+								},
+								{Field: "customer_id", Mode: cfg.RuleModeAnd, Weight: weight(50), Values: cfg.MatchValues{Gte: float(18)}},
+							},
+							Disable: []cfg.DisableRule{
+								{Field: "email", Values: cfg.MatchValues{Suffix: []string{"@example.com"}, NotIn: []string{"alex@example.com"}}},
+							},
+							SetVars: []cfg.SetVarRule{
+								{Field: "customer_id", Values: cfg.MatchValues{Eq: []string{"123"}}, Set: map[string]interface{}{"foo": "bar"}},
+							},
+						},
+					},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+
+			res, err := svc.Feature(context.Background(), "checkout_v3", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*res.Sources).To(Equal([]string{"checkout.yml"}))
+			Expect(*(*res.Requires)[0].Feature).To(Equal("payments_v2"))
+			Expect(*(*res.Requires)[0].Variant).To(Equal("treatment"))
+			Expect(*(*res.Variants)[0].Name).To(Equal("control"))
+
+			enable := *res.Rules.Enable
+			Expect(enable).To(HaveLen(2))
+			Expect(*enable[0].Id).To(Equal("beta"))
+			Expect(*enable[0].Variant).To(Equal("control"))
+			Expect(*enable[0].Match).To(Equal(
+				`any of (customer_id, email) in ["123", "456"] and ` +
+					`all(country eq ["NZ"] (ignoring case), app_version semver >= 4.2.0) and not(segment(staff))`,
+			))
+			Expect(*enable[1].Match).To(Equal(`customer_id >= 18`))
+			Expect(*enable[1].Mode).To(Equal(cfg.RuleModeAnd))
+			Expect(*enable[1].Weight).To(Equal(50))
+			Expect(*(*res.Rules.Disable)[0].Match).To(Equal(`email not_in ["alex@example.com"] and suffix ["@example.com"]`))
+			Expect(*(*res.Rules.SetVars)[0].Set).To(Equal(map[string]interface{}{"foo": "bar"}))
+
+			res, err = svc.Feature(context.Background(), "checkout_v3", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*(*res.Rules.Enable)[0].Match).To(HavePrefix(`any of (customer_id, email) in [2 values] and all(country eq [1 values]`))
+			Expect(*(*res.Rules.Disable)[0].Match).To(Equal(`email not_in [1 values] and suffix [1 values]`))
+			Expect(*(*res.Rules.SetVars)[0].Set).To(Equal(map[string]interface{}{"foo": "[redacted]"}))
+
+			_, err = svc.Feature(context.Background(), "payments_v2", false)
+			Expect(err).To(Equal(UnknownFeatureError{Feature: "payments_v2"}))
+		})
+	})
+
+	Describe("bucketing", func() {
+		cfgTwoFeatures := func(a, b cfg.Feature) cfg.Config {
+			for _, f := range []*cfg.Feature{&a, &b} {
+				f.Rules.Enable = []cfg.EnableRule{{Field: "customer_id", Weight: weight(50)}}
+			}
+			return cfg.Config{
+				Version:  "1.0",
+				Features: map[string]cfg.Feature{"feature_a": a, "feature_b": b},
+			}
+		}
+
+		// countSame returns the number of customers for which both features
+		// have the same status
+		countSame := func(config cfg.Config) int {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			same := 0
+			for i := 0; i < 200; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(i)})
+				res, err := svc.FeaturesStatus(context.Background(), req, "")
+				Expect(err).NotTo(HaveOccurred())
+				_, a := (*res.Features)["feature_a"]
+				_, b := (*res.Features)["feature_b"]
+				if a == b {
+					same++
+				}
+			}
+			return same
+		}
+
+		It("selects independent users for each feature with salted bucketing", func() {
+			Expect(countSame(cfgTwoFeatures(
+				cfg.Feature{Bucketing: cfg.BucketingSalted},
+				cfg.Feature{Bucketing: cfg.BucketingSalted},
+			))).To(BeNumerically("<", 150))
+		})
+
+		It("selects the same users for features with the same salt", func() {
+			Expect(countSame(cfgTwoFeatures(
+				cfg.Feature{Bucketing: cfg.BucketingSalted, Salt: "shared"},
+				cfg.Feature{Bucketing: cfg.BucketingSalted, Salt: "shared"},
+			))).To(Equal(200))
+		})
+
+		It("selects the same users for features with legacy bucketing", func() {
+			Expect(countSame(cfgTwoFeatures(
+				cfg.Feature{Bucketing: cfg.BucketingLegacy},
+				cfg.Feature{Bucketing: cfg.BucketingLegacy, Salt: "ignored"},
+			))).To(Equal(200))
+		})
+
+		It("uses legacy bucketing for features from version 1 files", func() {
+			Expect(countSame(cfgTwoFeatures(
+				cfg.Feature{},
+				cfg.Feature{Salt: "ignored"},
+			))).To(Equal(200))
+		})
+
+		// countEnabled returns the number of customers the feature is enabled
+		// for with a single rule of the given weight
+		countEnabled := func(version string, w int) int {
+			config := cfg.Config{
+				Version: version,
+				Features: map[string]cfg.Feature{
+					"feature": {Rules: cfg.Rules{
+						Enable: []cfg.EnableRule{{Field: "customer_id", Weight: weight(w)}},
+					}},
+				},
+			}
+			if version == "2.0" {
+				f := config.Features["feature"]
+				f.Bucketing = cfg.BucketingSalted
+				config.Features["feature"] = f
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			enabled := 0
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(i)})
+				res, err := svc.FeaturesStatus(context.Background(), req, "feature")
+				Expect(err).NotTo(HaveOccurred())
+				if _, ok := (*res.Features)["feature"]; ok {
+					enabled++
+				}
+			}
+			return enabled
+		}
+
+		It("enables no one at weight 1 with legacy bucketing", func() {
+			Expect(countEnabled("1.0", 1)).To(Equal(0))
+		})
+
+		It("enables everyone at weight 100 with salted bucketing", func() {
+			Expect(countEnabled("2.0", 100)).To(Equal(1000))
+		})
+	})
+
+	Describe("variants", func() {
+		It("splits users between variants according to their weights", func() {
+			config := cfgVariants()
+			f := config.Features["checkout"]
+			f.Variants.Allocation[0].Weight = 3
+			f.Variants.Allocation[1].Weight = 1
+			config.Features["checkout"] = f
+			svc := NewService(logrus.WithField("service", "test"), config)
+
+			counts := map[string]int{}
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(1000 + i)})
+				res, err := svc.FeaturesStatus(context.Background(), req, "checkout")
+				Expect(err).NotTo(HaveOccurred())
+				if status, ok := (*res.Features)["checkout"]; ok {
+					counts[*status.Variant]++
+				}
+			}
+			Expect(counts["control"]).To(BeNumerically("~", 750, 50))
+			Expect(counts["treatment"]).To(BeNumerically("~", 250, 50))
+		})
+
+		It("splits users matched by rules without fields using the variant fields", func() {
+			config := cfgVariants()
+			f := config.Features["checkout"]
+			f.Variants.Fields = []string{"customer_id"}
+			f.Rules.Enable = []cfg.EnableRule{{Conditions: cfg.Conditions{All: []cfg.Condition{
+				{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+			}}}}
+			config.Features["checkout"] = f
+			svc := NewService(logrus.WithField("service", "test"), config)
+
+			counts := map[string]int{}
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(1000 + i), "country": "NZ"})
+				res, err := svc.FeaturesStatus(context.Background(), req, "checkout")
+				Expect(err).NotTo(HaveOccurred())
+				counts[*(*res.Features)["checkout"].Variant]++
+			}
+			Expect(counts["control"]).To(BeNumerically("~", 500, 50))
+			Expect(counts["treatment"]).To(BeNumerically("~", 500, 50))
+		})
+
+		It("picks variants independently for features with the same allocation, even with legacy bucketing", func() {
+			config := cfgVariants()
+			config.Features["checkout_copy"] = config.Features["checkout"]
+			svc := NewService(logrus.WithField("service", "test"), config)
+
+			same := 0
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(1000 + i)})
+				res, err := svc.FeaturesStatus(context.Background(), req, "")
+				Expect(err).NotTo(HaveOccurred())
+				a, aOK := (*res.Features)["checkout"]
+				b, bOK := (*res.Features)["checkout_copy"]
+				if aOK && bOK && *a.Variant == *b.Variant {
+					same++
+				}
+			}
+			Expect(same).To(BeNumerically("~", 500, 50))
+		})
+	})
+
+	Describe("prerequisites", func() {
+		customers := func(ids ...string) []cfg.EnableRule {
+			return []cfg.EnableRule{{Field: "customer_id", Values: cfg.MatchValues{In: ids}}}
+		}
+
+		cfgPrerequisites := func() cfg.Config {
+			return cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"payments_v2": {
+						Variants: cfg.Variants{Allocation: []cfg.Variant{
+							{Name: "control", Weight: 1},
+							{Name: "treatment", Weight: 1},
+						}},
+						Rules: cfg.Rules{Enable: []cfg.EnableRule{
+							{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123"}}, Variant: "treatment"},
+							{Field: "customer_id", Values: cfg.MatchValues{In: []string{"456"}}, Variant: "control"},
+						}},
+					},
+					"checkout_v3": {
+						Requires: []cfg.Prerequisite{{Feature: "payments_v2"}},
+						Rules:    cfg.Rules{Enable: customers("123", "456", "789")},
+					},
+					"checkout_v3_treatment": {
+						Requires: []cfg.Prerequisite{{Feature: "payments_v2", Variant: "treatment"}},
+						Rules:    cfg.Rules{Enable: customers("123", "456", "789")},
+					},
+					"checkout_v4": {
+						Requires: []cfg.Prerequisite{{Feature: "checkout_v3"}},
+						Rules:    cfg.Rules{Enable: customers("123", "456", "789")},
+					},
+				},
+			}
+		}
+
+		enabled := func(svc *Service, customerID string, featureName string) []string {
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": customerID})
+			res, err := svc.FeaturesStatus(context.Background(), req, featureName)
+			Expect(err).NotTo(HaveOccurred())
+			names := []string{}
+			for name := range *res.Features {
+				names = append(names, name)
+			}
+			return names
+		}
+
+		It("only enables features when their prerequisites are enabled", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgPrerequisites())
+			Expect(enabled(svc, "123", "")).To(ConsistOf("payments_v2", "checkout_v3", "checkout_v3_treatment", "checkout_v4"))
+			Expect(enabled(svc, "456", "")).To(ConsistOf("payments_v2", "checkout_v3", "checkout_v4"))
+			Expect(enabled(svc, "789", "")).To(BeEmpty())
+		})
+
+		It("evaluates prerequisites when asked for a single feature", func() {
+			svc := NewService(logrus.WithField("service", "test"), cfgPrerequisites())
+			Expect(enabled(svc, "456", "checkout_v4")).To(ConsistOf("checkout_v4"))
+			Expect(enabled(svc, "789", "checkout_v4")).To(BeEmpty())
+		})
+
+		It("disables features that require each other", func() {
+			config := cfgPrerequisites()
+			f := config.Features["payments_v2"]
+			f.Requires = []cfg.Prerequisite{{Feature: "checkout_v3"}}
+			config.Features["payments_v2"] = f
+			svc := NewService(logrus.WithField("service", "test"), config)
+			Expect(enabled(svc, "123", "")).To(BeEmpty())
+		})
+	})
+
+	Describe("explanations", func() {
+		past := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		customers := func(ids ...string) cfg.MatchValues {
+			return cfg.MatchValues{In: ids}
+		}
+		config := cfg.Config{
+			Version: "1.0",
+			Features: map[string]cfg.Feature{
+				"targeted": {
+					Rules: cfg.Rules{
+						Enable: []cfg.EnableRule{
+							{Field: "customer_id", Values: customers("123")},
+							{ID: "beta", Field: "customer_id", Values: customers("456")},
+						},
+						Disable: []cfg.DisableRule{
+							{ID: "blocked", Field: "customer_id", Values: customers("789")},
+						},
+					},
+				},
+				"split": {
+					Rules: cfg.Rules{Enable: []cfg.EnableRule{{Field: "customer_id", Weight: weight(100)}}},
+				},
+				"expired": {
+					Window: cfg.Window{EndAt: &past},
+					Rules:  cfg.Rules{Enable: []cfg.EnableRule{{Field: "customer_id", Values: customers("123")}}},
+				},
+				"dependent": {
+					Requires: []cfg.Prerequisite{{Feature: "targeted"}},
+					Rules:    cfg.Rules{Enable: []cfg.EnableRule{{Field: "customer_id", Values: customers("999")}}},
+				},
+				"invalid": {
+					Rules: cfg.Rules{Enable: []cfg.EnableRule{{Field: "customer_id", Weight: weight(150)}}},
+				},
+			},
+		}
+
+		explain := func(featureName, customerID string) spec.FeatureStatus {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": customerID})
+			explain := true
+			req.Explain = &explain
+			res, err := svc.FeaturesStatus(context.Background(), req, featureName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*res.Features).To(HaveKey(featureName))
+			return (*res.Features)[featureName]
+		}
+
+		DescribeTable(
+			"reasons",
+			func(featureName, customerID string, enabled bool, expected *spec.Explanation) {
+				status := explain(featureName, customerID)
+				Expect(*status.Enabled).To(Equal(enabled))
+				Expect(status.Explanation).To(Equal(expected))
+			},
+			Entry("targeting match", "targeted", "456", true,
+				spec.NewExplanation(spec.ReasonTargetingMatch).WithRule(1, "beta")),
+			Entry("targeting match without an id", "targeted", "123", true,
+				spec.NewExplanation(spec.ReasonTargetingMatch).WithRule(0, "")),
+			Entry("disable match", "targeted", "789", false,
+				spec.NewExplanation(spec.ReasonDisableMatch).WithRule(0, "blocked")),
+			Entry("default", "targeted", "999", false,
+				spec.NewExplanation(spec.ReasonDefault)),
+			Entry("out of schedule", "expired", "123", false,
+				spec.NewExplanation(spec.ReasonOutOfSchedule)),
+			Entry("prerequisite failed", "dependent", "999", false,
+				spec.NewExplanation(spec.ReasonPrerequisiteFailed).WithPrerequisite("targeted")),
+			Entry("error", "invalid", "123", false,
+				spec.NewExplanation(spec.ReasonError).WithRule(0, "").
+					WithError(errors.New("weight (150) outside range 0-100"))),
+		)
+
+		It("explains splits with the bucket and weight", func() {
+			status := explain("split", "123")
+			Expect(*status.Enabled).To(BeTrue())
+			Expect(*status.Explanation.Reason).To(Equal(spec.ReasonSplit))
+			Expect(*status.Explanation.RuleIndex).To(Equal(0))
+			Expect(*status.Explanation.Bucket).To(BeNumerically("<=", 100))
+			Expect(*status.Explanation.Weight).To(Equal(100))
+		})
+
+		It("only includes disabled features and explanations when asked", func() {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			res, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(map[string]interface{}{"customer_id": "456"}), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*res.Features).To(HaveLen(2))
+			Expect(*res.Features).To(HaveKey("targeted"))
+			Expect((*res.Features)["targeted"].Explanation).To(BeNil())
+		})
+	})
+
+	Describe("snapshots", func() {
+		config := cfg.Config{
+			Version: "1.0",
+			Features: map[string]cfg.Feature{
+				"enabled": {
+					Rules: cfg.Rules{Enable: []cfg.EnableRule{{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123"}}}}},
+				},
+				"disabled": {},
+			},
+			Revision: "abc123",
+		}
+
+		It("includes disabled features when asked", func() {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			req := newFeaturesRequest(map[string]interface{}{"customer_id": "123"})
+			includeDisabled := true
+			req.IncludeDisabled = &includeDisabled
+			res, err := svc.FeaturesStatus(context.Background(), req, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*res.Features).To(HaveLen(2))
+			Expect(*(*res.Features)["enabled"].Enabled).To(BeTrue())
+			Expect(*(*res.Features)["disabled"].Enabled).To(BeFalse())
+			Expect((*res.Features)["disabled"].Explanation).To(BeNil())
+		})
+
+		It("returns the config version with disabled features", func() {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			for _, featureName := range []string{"", "disabled"} {
+				req := newFeaturesRequest(nil)
+				res, err := svc.FeaturesStatus(context.Background(), req, featureName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.ConfigVersion).To(BeNil())
+
+				includeDisabled := true
+				req.IncludeDisabled = &includeDisabled
+				res, err = svc.FeaturesStatus(context.Background(), req, featureName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*res.ConfigVersion).To(Equal("abc123"))
+			}
+		})
+	})
+
+	Describe("rule modes", func() {
+		cfgMode := func(mode string) cfg.Config {
+			return cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"feature": {
+						Rules: cfg.Rules{
+							Enable: []cfg.EnableRule{{
+								Field:  "customer_id",
+								Mode:   mode,
+								Weight: weight(50),
+								Conditions: cfg.Conditions{All: []cfg.Condition{
+									{Field: "plan", Values: cfg.MatchValues{Eq: []string{"enterprise"}}},
+								}},
+							}},
+							SetVars: []cfg.SetVarRule{{
+								Field:  "customer_id",
+								Mode:   mode,
+								Weight: weight(50),
+								Conditions: cfg.Conditions{All: []cfg.Condition{
+									{Field: "plan", Values: cfg.MatchValues{Eq: []string{"enterprise"}}},
+								}},
+								Set: map[string]interface{}{"beta": true},
+							}},
+						},
+					},
+				},
+			}
+		}
+
+		// count returns the number of customers on the plan that have the
+		// feature enabled, and the number that have the var set
+		count := func(config cfg.Config, plan string) (enabled, set int) {
+			svc := NewService(logrus.WithField("service", "test"), config)
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(i), "plan": plan})
+				res, err := svc.FeaturesStatus(context.Background(), req, "feature")
+				Expect(err).NotTo(HaveOccurred())
+				if status, ok := (*res.Features)["feature"]; ok {
+					enabled++
+					if status.Vars != nil && (*status.Vars)["beta"] == true {
+						set++
+					}
+				}
+			}
+			return enabled, set
+		}
+
+		It("enables matched users or a percentage of everyone in 'or' mode", func() {
+			for _, mode := range []string{"", cfg.RuleModeOr} {
+				enabled, _ := count(cfgMode(mode), "enterprise")
+				Expect(enabled).To(Equal(1000))
+				enabled, _ = count(cfgMode(mode), "free")
+				Expect(enabled).To(BeNumerically("~", 500, 50))
+			}
+		})
+
+		It("enables a percentage of matched users in 'and' mode", func() {
+			enabled, set := count(cfgMode(cfg.RuleModeAnd), "enterprise")
+			Expect(enabled).To(BeNumerically("~", 500, 50))
+			Expect(set).To(Equal(enabled))
+			enabled, _ = count(cfgMode(cfg.RuleModeAnd), "free")
+			Expect(enabled).To(Equal(0))
+		})
+
+		It("enables every matched user in 'and' mode without a weight", func() {
+			config := cfgMode(cfg.RuleModeAnd)
+			config.Features["feature"].Rules.Enable[0].Weight = nil
+			enabled, _ := count(config, "enterprise")
+			Expect(enabled).To(Equal(1000))
+			enabled, _ = count(config, "free")
+			Expect(enabled).To(Equal(0))
+		})
+
+		It("enables no one in 'and' mode with a weight of 0", func() {
+			config := cfgMode(cfg.RuleModeAnd)
+			config.Features["feature"].Rules.Enable[0].Weight = weight(0)
+			enabled, _ := count(config, "enterprise")
+			Expect(enabled).To(Equal(0))
+
+			// without targeting too, which used to enable everyone
+			config.Features["feature"].Rules.Enable[0].Conditions = cfg.Conditions{}
+			enabled, _ = count(config, "free")
+			Expect(enabled).To(Equal(0))
+		})
+
+		It("evaluates version 1 configs the same once they're migrated", func() {
+			v1 := []byte(`version: 1.0
+features:
+  paused:
+    rules:
+      enable:
+        - field: "customer_id"
+          weight: 0
+  paused_targeted:
+    rules:
+      enable:
+        - field: "customer_id"
+          weight: 0
+          values:
+            in: ["1", "2", "3"]
+  no_weight:
+    rules:
+      enable:
+        - field: "customer_id"
+  no_weight_targeted:
+    rules:
+      enable:
+        - field: "plan"
+          values:
+            eq: ["enterprise"]
+      set_vars:
+        - field: "plan"
+          values:
+            eq: ["enterprise"]
+          set:
+            beta: true
+        - field: "customer_id"
+          set:
+            other: true
+  weighted_targeted:
+    rules:
+      enable:
+        - field: "customer_id"
+          weight: 30
+          values:
+            in: ["1", "2", "3"]
+`)
+			v2, changed, err := cfg.MigrateYAML(v1, "v1.yml")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeTrue())
+
+			statuses := func(b []byte) []map[string]spec.FeatureStatus {
+				config, err := cfg.LoadYAML(bytes.NewReader(b))
+				Expect(err).NotTo(HaveOccurred())
+				svc := NewService(logrus.WithField("service", "test"), config)
+				var statuses []map[string]spec.FeatureStatus
+				for i := 0; i < 200; i++ {
+					for _, plan := range []string{"enterprise", "free"} {
+						req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(i), "plan": plan})
+						res, err := svc.FeaturesStatus(context.Background(), req, "")
+						Expect(err).NotTo(HaveOccurred())
+						statuses = append(statuses, *res.Features)
+					}
+				}
+				return statuses
+			}
+			before := statuses(v1)
+			Expect(statuses(v2)).To(Equal(before))
+			for _, s := range before {
+				Expect(s).NotTo(HaveKey("paused"))
+				Expect(s).NotTo(HaveKey("no_weight"))
+			}
+		})
+	})
+
+	DescribeTable(
+		"match values",
+		func(values cfg.MatchValues, email string, expected bool) {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"enable": {
+						Rules: cfg.Rules{
+							Enable: []cfg.EnableRule{{Field: "email", Values: values}},
+						},
+					},
+					"disable": {
+						Rules: cfg.Rules{
+							Enable:  []cfg.EnableRule{{Field: "email", Values: cfg.MatchValues{Regex: []string{".*"}}}},
+							Disable: []cfg.DisableRule{{Field: "email", Values: values}},
+						},
+					},
+					"set_vars": {
+						Rules: cfg.Rules{
+							Enable:  []cfg.EnableRule{{Field: "email", Values: cfg.MatchValues{Regex: []string{".*"}}}},
+							SetVars: []cfg.SetVarRule{{Field: "email", Values: values, Set: map[string]interface{}{"matched": true}}},
+						},
+					},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			res, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(map[string]interface{}{"email": email}), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, enabled := (*res.Features)["enable"]
+			_, notDisabled := (*res.Features)["disable"]
+			Expect(enabled).To(Equal(expected), "enable rule")
+			Expect(notDisabled).To(Equal(!expected), "disable rule")
+			Expect((*res.Features)["set_vars"].Vars != nil).To(Equal(expected), "set_vars rule")
+		},
+		Entry("no operators", cfg.MatchValues{}, "alex@example.com", false),
+		Entry("eq", cfg.MatchValues{Eq: []string{"alex@example.com"}}, "alex@example.com", true),
+		Entry("eq is case sensitive", cfg.MatchValues{Eq: []string{"Alex@example.com"}}, "alex@example.com", false),
+		Entry("eq with ignore_case", cfg.MatchValues{Eq: []string{"Alex@example.com"}, IgnoreCase: true}, "alex@example.com", true),
+		Entry("neq", cfg.MatchValues{Neq: []string{"sam@example.com"}}, "alex@example.com", true),
+		Entry("neq with a listed value", cfg.MatchValues{Neq: []string{"alex@example.com"}}, "alex@example.com", false),
+		Entry("in", cfg.MatchValues{In: []string{"sam@example.com", "alex@example.com"}}, "alex@example.com", true),
+		Entry("not_in", cfg.MatchValues{NotIn: []string{"sam@example.com", "alex@example.com"}}, "alex@example.com", false),
+		Entry("not_in with ignore_case", cfg.MatchValues{NotIn: []string{"ALEX@example.com"}, IgnoreCase: true}, "alex@example.com", false),
+		Entry("prefix", cfg.MatchValues{Prefix: []string{"sam", "alex"}}, "alex@example.com", true),
+		Entry("prefix with ignore_case", cfg.MatchValues{Prefix: []string{"ALEX"}, IgnoreCase: true}, "alex@example.com", true),
+		Entry("suffix", cfg.MatchValues{Suffix: []string{"@example.com"}}, "alex@example.com", true),
+		Entry("suffix that doesn't match", cfg.MatchValues{Suffix: []string{"@example.org"}}, "alex@example.com", false),
+		Entry("contains", cfg.MatchValues{Contains: []string{"@"}}, "alex@example.com", true),
+		Entry("regex", cfg.MatchValues{Regex: []string{`^[a-z]+@example\.com$`}}, "alex@example.com", true),
+		Entry("regex is case sensitive", cfg.MatchValues{Regex: []string{`^ALEX@`}}, "alex@example.com", false),
+		Entry("regex with ignore_case", cfg.MatchValues{Regex: []string{`^ALEX@`}, IgnoreCase: true}, "alex@example.com", true),
+		Entry("every operator must match", cfg.MatchValues{Suffix: []string{"@example.com"}, NotIn: []string{"alex@example.com"}}, "alex@example.com", false),
+	)
+
+	DescribeTable(
+		"numeric and semver match values",
+		func(values cfg.MatchValues, value interface{}, expected bool) {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"feature": {
+						Rules: cfg.Rules{
+							Enable: []cfg.EnableRule{{Field: "value", Values: values}},
+						},
+					},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			res, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(map[string]interface{}{"value": value}), "")
+			Expect(err).NotTo(HaveOccurred())
+			_, enabled := (*res.Features)["feature"]
+			Expect(enabled).To(Equal(expected))
+		},
+		Entry("gt", cfg.MatchValues{Gt: float(30)}, float64(31), true),
+		Entry("gt at the boundary", cfg.MatchValues{Gt: float(30)}, float64(30), false),
+		Entry("gte at the boundary", cfg.MatchValues{Gte: float(30)}, float64(30), true),
+		Entry("lt", cfg.MatchValues{Lt: float(30)}, float64(29.5), true),
+		Entry("lte", cfg.MatchValues{Lte: float(30)}, float64(30.5), false),
+		Entry("numbers are compared numerically, not as strings", cfg.MatchValues{Gt: float(9)}, float64(10), true),
+		Entry("strings containing numbers are compared numerically", cfg.MatchValues{Gt: float(9)}, "10", true),
+		Entry("non-numeric values don't match", cfg.MatchValues{Gt: float(9)}, "ten", false),
+		Entry("between", cfg.MatchValues{Between: []float64{1, 10}}, float64(10), true),
+		Entry("outside between", cfg.MatchValues{Between: []float64{1, 10}}, float64(11), false),
+		Entry("combined with other operators", cfg.MatchValues{Gte: float(1), NotIn: []string{"5"}}, float64(5), false),
+		Entry("semver gte", cfg.MatchValues{Semver: cfg.SemverMatch{Gte: "4.2.0"}}, "4.10.0", true),
+		Entry("semver gte below", cfg.MatchValues{Semver: cfg.SemverMatch{Gte: "4.2.0"}}, "4.2.0-beta.1", false),
+		Entry("semver eq", cfg.MatchValues{Semver: cfg.SemverMatch{Eq: "4.2"}}, "v4.2.0", true),
+		Entry("semver between", cfg.MatchValues{Semver: cfg.SemverMatch{Between: []string{"4.0.0", "4.9.9"}}}, "4.9.9", true),
+		Entry("semver lt with an invalid version", cfg.MatchValues{Semver: cfg.SemverMatch{Lt: "5.0.0"}}, "latest", false),
+	)
+
+	DescribeTable(
+		"time windows",
+		func(feature cfg.Feature, now string, expected bool) {
+			feature.Rules.Enable = append(feature.Rules.Enable, cfg.EnableRule{
+				Field:  "customer_id",
+				Values: cfg.MatchValues{Eq: []string{"123"}},
+			})
+			config := cfg.Config{
+				Version:  "1.0",
+				Features: map[string]cfg.Feature{"feature": feature},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			svc.SetClock(ClockFunc(func() time.Time { return *timestamp(now) }))
+			res, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(map[string]interface{}{"customer_id": "123"}), "")
+			Expect(err).NotTo(HaveOccurred())
+			_, enabled := (*res.Features)["feature"]
+			Expect(enabled).To(Equal(expected))
+		},
+		Entry(
+			"before the feature's start_at",
+			cfg.Feature{Window: cfg.Window{StartAt: timestamp("2021-06-01T00:00:00Z")}},
+			"2021-05-31T23:59:59Z",
+			false,
+		),
+		Entry(
+			"at the feature's start_at",
+			cfg.Feature{Window: cfg.Window{StartAt: timestamp("2021-06-01T00:00:00Z")}},
+			"2021-06-01T00:00:00Z",
+			true,
+		),
+		Entry(
+			"just before the feature's end_at",
+			cfg.Feature{Window: cfg.Window{EndAt: timestamp("2021-06-01T00:00:00+12:00")}},
+			"2021-05-31T11:59:59Z",
+			true,
+		),
+		Entry(
+			"at the feature's end_at",
+			cfg.Feature{Window: cfg.Window{EndAt: timestamp("2021-06-01T00:00:00+12:00")}},
+			"2021-05-31T12:00:00Z",
+			false,
+		),
+		Entry(
+			"a disable rule outside its window is ignored",
+			cfg.Feature{Rules: cfg.Rules{Disable: []cfg.DisableRule{{
+				Window: cfg.Window{StartAt: timestamp("2021-06-01T00:00:00Z")},
+				Field:  "customer_id",
+				Values: cfg.MatchValues{Eq: []string{"123"}},
+			}}}},
+			"2021-05-31T00:00:00Z",
+			true,
+		),
+		Entry(
+			"a disable rule inside its window applies",
+			cfg.Feature{Rules: cfg.Rules{Disable: []cfg.DisableRule{{
+				Window: cfg.Window{StartAt: timestamp("2021-06-01T00:00:00Z")},
+				Field:  "customer_id",
+				Values: cfg.MatchValues{Eq: []string{"123"}},
+			}}}},
+			"2021-06-01T00:00:00Z",
+			false,
+		),
+		Entry(
+			"during a recurring schedule in another time zone",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"fri"},
+				StartTime: "09:00",
+				EndTime:   "17:00",
+				TimeZone:  "Pacific/Auckland",
+			}}},
+			"2021-06-03T21:00:00Z", // Friday 09:00 in Auckland
+			true,
+		),
+		Entry(
+			"at the end of a recurring schedule",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"fri"},
+				StartTime: "09:00",
+				EndTime:   "17:00",
+				TimeZone:  "Pacific/Auckland",
+			}}},
+			"2021-06-04T05:00:00Z", // Friday 17:00 in Auckland
+			false,
+		),
+		Entry(
+			"before the start of a recurring schedule",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"fri"},
+				StartTime: "09:00",
+				EndTime:   "17:00",
+				TimeZone:  "Pacific/Auckland",
+			}}},
+			"2021-06-03T20:59:00Z", // Friday 08:59 in Auckland
+			false,
+		),
+		Entry(
+			"on a day that isn't in the schedule",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"fri"},
+				StartTime: "09:00",
+				EndTime:   "17:00",
+				TimeZone:  "Pacific/Auckland",
+			}}},
+			"2021-06-02T21:00:00Z", // Thursday 09:00 in Auckland
+			false,
+		),
+		Entry(
+			"after midnight in an overnight schedule",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"saturday"},
+				StartTime: "22:00",
+				EndTime:   "02:00",
+			}}},
+			"2021-06-06T01:59:00Z", // Sunday
+			true,
+		),
+		Entry(
+			"after midnight in an overnight schedule that started on a day that isn't in the schedule",
+			cfg.Feature{Window: cfg.Window{Schedule: &cfg.Schedule{
+				Days:      []string{"sunday"},
+				StartTime: "22:00",
+				EndTime:   "02:00",
+			}}},
+			"2021-06-06T01:59:00Z", // Sunday
+			false,
+		),
+	)
+
+	Describe("ramps", func() {
+		// enabledAt returns the customers the feature is enabled for at the
+		// given time
+		enabledAt := func(ramp cfg.Ramp, now string) map[int]bool {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"feature": {
+						Rules: cfg.Rules{
+							Enable: []cfg.EnableRule{{Field: "customer_id", Weight: weight(5), Ramp: &ramp}},
+						},
+					},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			svc.SetClock(ClockFunc(func() time.Time { return *timestamp(now) }))
+
+			enabled := map[int]bool{}
+			for i := 0; i < 1000; i++ {
+				req := newFeaturesRequest(map[string]interface{}{"customer_id": strconv.Itoa(i)})
+				res, err := svc.FeaturesStatus(context.Background(), req, "feature")
+				Expect(err).NotTo(HaveOccurred())
+				if _, ok := (*res.Features)["feature"]; ok {
+					enabled[i] = true
+				}
+			}
+			return enabled
+		}
+
+		It("increases the weight linearly, keeping users who already had the feature", func() {
+			ramp := cfg.Ramp{
+				StartAt: timestamp("2021-06-01T00:00:00Z"),
+				EndAt:   timestamp("2021-06-11T00:00:00Z"),
+				From:    0,
+				To:      100,
+			}
+			Expect(enabledAt(ramp, "2021-05-31T00:00:00Z")).To(BeEmpty())
+
+			previous := map[int]bool{}
+			for _, now := range []string{"2021-06-02T00:00:00Z", "2021-06-06T00:00:00Z", "2021-06-10T00:00:00Z"} {
+				enabled := enabledAt(ramp, now)
+				for customer := range previous {
+					Expect(enabled).To(HaveKey(customer))
+				}
+				previous = enabled
+			}
+			Expect(len(enabledAt(ramp, "2021-06-06T00:00:00Z"))).To(BeNumerically("~", 490, 50))
+			Expect(enabledAt(ramp, "2021-06-11T00:00:00Z")).To(HaveLen(1000))
+		})
+
+		It("uses the weight from the latest step", func() {
+			ramp := cfg.Ramp{
+				Steps: []cfg.RampStep{
+					{At: *timestamp("2021-06-01T00:00:00Z"), Weight: 25},
+					{At: *timestamp("2021-06-08T00:00:00Z"), Weight: 50},
+				},
+			}
+			Expect(len(enabledAt(ramp, "2021-05-31T00:00:00Z"))).To(BeNumerically("~", 40, 20))
+			Expect(len(enabledAt(ramp, "2021-06-07T23:59:59Z"))).To(BeNumerically("~", 240, 50))
+			Expect(len(enabledAt(ramp, "2021-06-08T00:00:00Z"))).To(BeNumerically("~", 490, 50))
+		})
+	})
+
+	DescribeTable(
+		"conditions",
+		func(rule cfg.EnableRule, vars map[string]interface{}, expected bool) {
+			config := cfg.Config{
+				Version: "1.0",
+				Features: map[string]cfg.Feature{
+					"feature": {Rules: cfg.Rules{Enable: []cfg.EnableRule{rule}}},
+				},
+				Segments: map[string]cfg.Condition{
+					"beta_customers": {Field: "customer_id", Values: cfg.MatchValues{In: []string{"123", "456"}}},
+				},
+			}
+			svc := NewService(logrus.WithField("service", "test"), config)
+			res, err := svc.FeaturesStatus(context.Background(), newFeaturesRequest(vars), "")
+			Expect(err).NotTo(HaveOccurred())
+			_, enabled := (*res.Features)["feature"]
+			Expect(enabled).To(Equal(expected))
+		},
+		Entry(
+			"all matches when every condition is true",
+			cfg.EnableRule{Conditions: cfg.Conditions{All: []cfg.Condition{
+				{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123", "456"}}},
+				{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+			}}},
+			map[string]interface{}{"customer_id": "123", "country": "NZ"},
+			true,
+		),
+		Entry(
+			"all doesn't match when any condition is false",
+			cfg.EnableRule{Conditions: cfg.Conditions{All: []cfg.Condition{
+				{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123", "456"}}},
+				{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+			}}},
+			map[string]interface{}{"customer_id": "123", "country": "AU"},
+			false,
+		),
+		Entry(
+			"any matches when one condition is true",
+			cfg.EnableRule{Conditions: cfg.Conditions{Any: []cfg.Condition{
+				{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123", "456"}}},
+				{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+			}}},
+			map[string]interface{}{"customer_id": "789", "country": "NZ"},
+			true,
+		),
+		Entry(
+			"not matches when its condition is false",
+			cfg.EnableRule{Conditions: cfg.Conditions{Not: &cfg.Condition{
+				Field: "internal", Values: cfg.MatchValues{Eq: []string{"true"}},
+			}}},
+			map[string]interface{}{"customer_id": "123"},
+			true,
+		),
+		Entry(
+			"not doesn't match when its condition is true",
+			cfg.EnableRule{Conditions: cfg.Conditions{Not: &cfg.Condition{
+				Field: "internal", Values: cfg.MatchValues{Eq: []string{"true"}},
+			}}},
+			map[string]interface{}{"customer_id": "123", "internal": true},
+			false,
+		),
+		Entry(
+			"nested conditions",
+			cfg.EnableRule{Conditions: cfg.Conditions{All: []cfg.Condition{
+				{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+				{Conditions: cfg.Conditions{
+					Any: []cfg.Condition{
+						{Field: "customer_id", Values: cfg.MatchValues{In: []string{"123"}}},
+						{Field: "plan", Values: cfg.MatchValues{Eq: []string{"enterprise"}}},
+					},
+					Not: &cfg.Condition{Field: "internal", Values: cfg.MatchValues{Eq: []string{"true"}}},
+				}},
+			}}},
+			map[string]interface{}{"customer_id": "789", "country": "NZ", "plan": "enterprise"},
+			true,
+		),
+		Entry(
+			"segment matches",
+			cfg.EnableRule{Conditions: cfg.Conditions{Segment: "beta_customers"}},
+			map[string]interface{}{"customer_id": "456"},
+			true,
+		),
+		Entry(
+			"segment doesn't match",
+			cfg.EnableRule{Conditions: cfg.Conditions{Segment: "beta_customers"}},
+			map[string]interface{}{"customer_id": "789"},
+			false,
+		),
+		Entry(
+			"undefined segment never matches",
+			cfg.EnableRule{Conditions: cfg.Conditions{Segment: "staff"}},
+			map[string]interface{}{"customer_id": "456"},
+			false,
+		),
+		Entry(
+			"segment nested in conditions",
+			cfg.EnableRule{Conditions: cfg.Conditions{Not: &cfg.Condition{
+				Conditions: cfg.Conditions{Segment: "beta_customers"},
+			}}},
+			map[string]interface{}{"customer_id": "789"},
+			true,
+		),
+		Entry(
+			"conditions are combined with the rule's values",
+			cfg.EnableRule{
+				Field:  "customer_id",
+				Values: cfg.MatchValues{Eq: []string{"123"}},
+				Conditions: cfg.Conditions{All: []cfg.Condition{
+					{Field: "country", Values: cfg.MatchValues{Eq: []string{"NZ"}}},
+				}},
+			},
+			map[string]interface{}{"customer_id": "123", "country": "AU"},
+			false,
+		),
+	)
 })
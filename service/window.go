@@ -0,0 +1,133 @@
+package service
+
+import (
+	"time"
+
+	"github.com/dylannz/feature-service/cfg"
+	"github.com/pkg/errors"
+)
+
+// Clock tells the service what the time is, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// loadLocations loads the time zone of every schedule in the config so they
+// don't have to be loaded on each request. The config loader has already
+// rejected unknown time zones, so any that fail to load here are returned to
+// be logged, and their schedules are never active.
+func loadLocations(config cfg.Config) (map[string]*time.Location, []error) {
+	locations := map[string]*time.Location{"": time.UTC}
+	var errs []error
+	add := func(w cfg.Window) {
+		if w.Schedule == nil {
+			return
+		}
+		if _, ok := locations[w.Schedule.TimeZone]; ok {
+			return
+		}
+		loc, err := time.LoadLocation(w.Schedule.TimeZone)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "load time zone"))
+			return
+		}
+		locations[w.Schedule.TimeZone] = loc
+	}
+
+	for _, feature := range config.Features {
+		add(feature.Window)
+		for _, rule := range feature.Rules.Enable {
+			add(rule.Window)
+		}
+		for _, rule := range feature.Rules.Disable {
+			add(rule.Window)
+		}
+	}
+	return locations, errs
+}
+
+// windowActive reports whether now is inside the window.
+func (st *state) windowActive(w cfg.Window, now time.Time) bool {
+	if w.StartAt != nil && now.Before(*w.StartAt) {
+		return false
+	}
+	if w.EndAt != nil && !now.Before(*w.EndAt) {
+		return false
+	}
+	if w.Schedule == nil {
+		return true
+	}
+
+	loc, ok := st.locations[w.Schedule.TimeZone]
+	if !ok {
+		return false
+	}
+	now = now.In(loc)
+	day := now.Weekday()
+	minute := now.Hour()*60 + now.Minute()
+
+	start, end := 0, 24*60
+	if w.Schedule.StartTime != "" {
+		start, _ = cfg.ParseTimeOfDay(w.Schedule.StartTime)
+	}
+	if w.Schedule.EndTime != "" {
+		end, _ = cfg.ParseTimeOfDay(w.Schedule.EndTime)
+	}
+	if end <= start {
+		// the schedule runs overnight, so after midnight it's still part of
+		// the previous day's schedule
+		if minute >= start {
+			return scheduledDay(w.Schedule, day)
+		}
+		return minute < end && scheduledDay(w.Schedule, (day+6)%7)
+	}
+	return minute >= start && minute < end && scheduledDay(w.Schedule, day)
+}
+
+// rampWeight returns the weight of the enable rule at the given time, taking
+// its ramp into account.
+func rampWeight(rule cfg.EnableRule, now time.Time) int {
+	r := rule.Ramp
+	switch {
+	case r == nil:
+		return rule.WeightOrZero()
+	case r.StartAt != nil && r.EndAt != nil:
+		if now.Before(*r.StartAt) {
+			return r.From
+		}
+		if !now.Before(*r.EndAt) {
+			return r.To
+		}
+		elapsed := now.Sub(*r.StartAt)
+		total := r.EndAt.Sub(*r.StartAt)
+		return r.From + int(float64(r.To-r.From)*float64(elapsed)/float64(total))
+	}
+
+	weight := rule.WeightOrZero()
+	for _, step := range r.Steps {
+		if now.Before(step.At) {
+			break
+		}
+		weight = step.Weight
+	}
+	return weight
+}
+
+func scheduledDay(s *cfg.Schedule, day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if wd, err := cfg.ParseWeekday(d); err == nil && wd == day {
+			return true
+		}
+	}
+	return false
+}
@@ -13,12 +13,21 @@ import (
 
 // ServerInterface represents all server handlers.
 type ServerInterface interface {
+	// Lists every feature in the config with its metadata and rules.
+	// (GET /features)
+	GetFeatures(w http.ResponseWriter, r *http.Request, params GetFeaturesParams)
+	// Fetches the status of features for many sets of vars at once.
+	// (POST /features/batch)
+	PostFeaturesBatch(w http.ResponseWriter, r *http.Request)
 	// Fetches a list of enabled features.
 	// (POST /features/status)
 	PostFeaturesStatus(w http.ResponseWriter, r *http.Request)
 	// Tells you if a specific feature is enabled.
 	// (POST /features/status/{feature})
 	PostFeaturesStatusFeature(w http.ResponseWriter, r *http.Request, feature string)
+	// Fetches a feature's metadata and rules from the config.
+	// (GET /features/{name})
+	GetFeaturesName(w http.ResponseWriter, r *http.Request, name string, params GetFeaturesNameParams)
 }
 
 // ServerInterfaceWrapper converts contexts to parameters.
@@ -29,6 +38,52 @@ type ServerInterfaceWrapper struct {
 
 type MiddlewareFunc func(http.HandlerFunc) http.HandlerFunc
 
+// GetFeatures operation middleware
+func (siw *ServerInterfaceWrapper) GetFeatures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetFeaturesParams
+
+	// ------------- Optional query parameter "redact" -------------
+	if paramValue := r.URL.Query().Get("redact"); paramValue != "" {
+
+	}
+
+	err = runtime.BindQueryParameter("form", true, false, "redact", r.URL.Query(), &params.Redact)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid format for parameter redact: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetFeatures(w, r, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// PostFeaturesBatch operation middleware
+func (siw *ServerInterfaceWrapper) PostFeaturesBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostFeaturesBatch(w, r)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
 // PostFeaturesStatus operation middleware
 func (siw *ServerInterfaceWrapper) PostFeaturesStatus(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -70,6 +125,46 @@ func (siw *ServerInterfaceWrapper) PostFeaturesStatusFeature(w http.ResponseWrit
 	handler(w, r.WithContext(ctx))
 }
 
+// GetFeaturesName operation middleware
+func (siw *ServerInterfaceWrapper) GetFeaturesName(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "name" -------------
+	var name string
+
+	err = runtime.BindStyledParameter("simple", false, "name", chi.URLParam(r, "name"), &name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid format for parameter name: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetFeaturesNameParams
+
+	// ------------- Optional query parameter "redact" -------------
+	if paramValue := r.URL.Query().Get("redact"); paramValue != "" {
+
+	}
+
+	err = runtime.BindQueryParameter("form", true, false, "redact", r.URL.Query(), &params.Redact)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid format for parameter redact: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetFeaturesName(w, r, name, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
 // Handler creates http.Handler with routing matching OpenAPI spec.
 func Handler(si ServerInterface) http.Handler {
 	return HandlerWithOptions(si, ChiServerOptions{})
@@ -107,12 +202,21 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 		HandlerMiddlewares: options.Middlewares,
 	}
 
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/features", wrapper.GetFeatures)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/features/batch", wrapper.PostFeaturesBatch)
+	})
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/features/status", wrapper.PostFeaturesStatus)
 	})
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/features/status/{feature}", wrapper.PostFeaturesStatusFeature)
 	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/features/{name}", wrapper.GetFeaturesName)
+	})
 
 	return r
 }
@@ -3,28 +3,211 @@
 // Code generated by github.com/deepmap/oapi-codegen DO NOT EDIT.
 package spec
 
+import (
+	"time"
+)
+
+// BatchItem defines model for BatchItem.
+type BatchItem struct {
+
+	// Identifies the item's result in the response. Defaults to the item's index in the request.
+	Key  *string                 `json:"key,omitempty"`
+	Vars *map[string]interface{} `json:"vars,omitempty"`
+}
+
+// BatchRequest defines model for BatchRequest.
+type BatchRequest struct {
+
+	// Explain why each feature is enabled or disabled. Disabled features are included in the results.
+	Explain *bool `json:"explain,omitempty"`
+
+	// Only evaluate these features.
+	Features *[]string `json:"features,omitempty"`
+
+	// Include disabled features in the results, so each is a complete snapshot.
+	IncludeDisabled *bool       `json:"include_disabled,omitempty"`
+	Items           []BatchItem `json:"items"`
+
+	// Only evaluate features whose names start with this prefix.
+	Prefix *string `json:"prefix,omitempty"`
+
+	// Only evaluate features with any of these tags.
+	Tags *[]string `json:"tags,omitempty"`
+}
+
+// BatchResponse defines model for BatchResponse.
+type BatchResponse struct {
+
+	// Identifies the config the features were evaluated with. Only returned with include_disabled.
+	ConfigVersion *string                 `json:"config_version,omitempty"`
+	Results       *map[string]BatchResult `json:"results,omitempty"`
+}
+
+// BatchResult defines model for BatchResult.
+type BatchResult struct {
+	Error    *Error                    `json:"error,omitempty"`
+	Features *map[string]FeatureStatus `json:"features,omitempty"`
+}
+
+// Error defines model for Error.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Why a feature is enabled or disabled.
+type Explanation struct {
+
+	// The bucket (1-100) the vars hashed to, for weighted rules.
+	Bucket *int    `json:"bucket,omitempty"`
+	Error  *string `json:"error,omitempty"`
+
+	// The required feature that wasn't enabled.
+	Prerequisite *string `json:"prerequisite,omitempty"`
+	Reason       *string `json:"reason,omitempty"`
+	RuleId       *string `json:"rule_id,omitempty"`
+
+	// The index of the rule that decided the status, within the feature's enable or disable rules.
+	RuleIndex *int `json:"rule_index,omitempty"`
+	Weight    *int `json:"weight,omitempty"`
+}
+
+// FeatureCatalog defines model for FeatureCatalog.
+type FeatureCatalog struct {
+
+	// Identifies the config the catalog was built from. It changes whenever the config files do.
+	ConfigVersion *string                 `json:"config_version,omitempty"`
+	Features      *map[string]FeatureInfo `json:"features,omitempty"`
+}
+
+// A feature's metadata from the config.
+type FeatureInfo struct {
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Description *string    `json:"description,omitempty"`
+
+	// Whether the feature is past its expires_at, and should be removed from the config.
+	Expired   *bool           `json:"expired,omitempty"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	Owner     *string         `json:"owner,omitempty"`
+	Requires  *[]Prerequisite `json:"requires,omitempty"`
+	Rules     *RuleSummaries  `json:"rules,omitempty"`
+
+	// The config files the feature is defined in.
+	Sources  *[]string         `json:"sources,omitempty"`
+	Tags     *[]string         `json:"tags,omitempty"`
+	Variants *[]VariantSummary `json:"variants,omitempty"`
+}
+
 // FeatureStatus defines model for FeatureStatus.
 type FeatureStatus struct {
-	Enabled *bool                   `json:"enabled,omitempty"`
-	Vars    *map[string]interface{} `json:"vars,omitempty"`
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Why a feature is enabled or disabled.
+	Explanation *Explanation            `json:"explanation,omitempty"`
+	Variant     *string                 `json:"variant,omitempty"`
+	Vars        *map[string]interface{} `json:"vars,omitempty"`
 }
 
 // FeaturesRequest defines model for FeaturesRequest.
 type FeaturesRequest struct {
+
+	// Explain why each feature is enabled or disabled. Disabled features are included in the response.
+	Explain *bool `json:"explain,omitempty"`
+
+	// Only evaluate these features.
+	Features *[]string `json:"features,omitempty"`
+
+	// Include disabled features in the response, so it's a complete snapshot of every feature.
+	IncludeDisabled *bool `json:"include_disabled,omitempty"`
+
+	// Only evaluate features whose names start with this prefix.
+	Prefix *string `json:"prefix,omitempty"`
+
+	// Only evaluate features with any of these tags.
+	Tags *[]string               `json:"tags,omitempty"`
 	Vars *map[string]interface{} `json:"vars,omitempty"`
 }
 
 // FeaturesResponse defines model for FeaturesResponse.
 type FeaturesResponse struct {
-	Features *map[string]FeatureStatus `json:"features,omitempty"`
+
+	// Identifies the config the features were evaluated with. It changes whenever the config files do. Only returned with include_disabled.
+	ConfigVersion *string                   `json:"config_version,omitempty"`
+	Features      *map[string]FeatureStatus `json:"features,omitempty"`
+}
+
+// Prerequisite defines model for Prerequisite.
+type Prerequisite struct {
+	Feature *string `json:"feature,omitempty"`
+	Variant *string `json:"variant,omitempty"`
+}
+
+// RuleSummaries defines model for RuleSummaries.
+type RuleSummaries struct {
+	Disable *[]RuleSummary `json:"disable,omitempty"`
+	Enable  *[]RuleSummary `json:"enable,omitempty"`
+	SetVars *[]RuleSummary `json:"set_vars,omitempty"`
 }
 
+// A summary of a rule from the config.
+type RuleSummary struct {
+	EndAt *time.Time `json:"end_at,omitempty"`
+	Id    *string    `json:"id,omitempty"`
+
+	// A description of the vars the rule matches.
+	Match *string `json:"match,omitempty"`
+	Mode  *string `json:"mode,omitempty"`
+
+	// Whether the rule's weight changes over time.
+	Ramp *bool `json:"ramp,omitempty"`
+
+	// Whether the rule only applies at certain times of the week.
+	Schedule *bool `json:"schedule,omitempty"`
+
+	// The vars a set_vars rule sets.
+	Set     *map[string]interface{} `json:"set,omitempty"`
+	StartAt *time.Time              `json:"start_at,omitempty"`
+	Variant *string                 `json:"variant,omitempty"`
+
+	// The rule's weight, as of now if it has a ramp.
+	Weight *int `json:"weight,omitempty"`
+}
+
+// VariantSummary defines model for VariantSummary.
+type VariantSummary struct {
+	Name   *string `json:"name,omitempty"`
+	Weight *int    `json:"weight,omitempty"`
+}
+
+// Redact defines model for Redact.
+type Redact bool
+
+// GetFeaturesParams defines parameters for GetFeatures.
+type GetFeaturesParams struct {
+
+	// Replace the lists of values that rules match (eq, neq, in, not_in, prefix, suffix, contains and regex) with the number of values, as they might contain personal information, and the values of the vars set_vars rules set with '[redacted]', as they might contain secrets.
+	Redact *Redact `json:"redact,omitempty"`
+}
+
+// PostFeaturesBatchJSONBody defines parameters for PostFeaturesBatch.
+type PostFeaturesBatchJSONBody BatchRequest
+
 // PostFeaturesStatusJSONBody defines parameters for PostFeaturesStatus.
 type PostFeaturesStatusJSONBody FeaturesRequest
 
 // PostFeaturesStatusFeatureJSONBody defines parameters for PostFeaturesStatusFeature.
 type PostFeaturesStatusFeatureJSONBody FeaturesRequest
 
+// GetFeaturesNameParams defines parameters for GetFeaturesName.
+type GetFeaturesNameParams struct {
+
+	// Replace the lists of values that rules match (eq, neq, in, not_in, prefix, suffix, contains and regex) with the number of values, as they might contain personal information, and the values of the vars set_vars rules set with '[redacted]', as they might contain secrets.
+	Redact *Redact `json:"redact,omitempty"`
+}
+
+// PostFeaturesBatchJSONRequestBody defines body for PostFeaturesBatch for application/json ContentType.
+type PostFeaturesBatchJSONRequestBody PostFeaturesBatchJSONBody
+
 // PostFeaturesStatusJSONRequestBody defines body for PostFeaturesStatus for application/json ContentType.
 type PostFeaturesStatusJSONRequestBody PostFeaturesStatusJSONBody
 
@@ -18,3 +18,121 @@ func (r *FeaturesResponse) AddStatus(featureName string, enabled bool, vars map[
 	(*r.Features)[featureName] = s
 	return r
 }
+
+func (r *FeaturesResponse) SetVariant(featureName, variant string) *FeaturesResponse {
+	s := (*r.Features)[featureName]
+	s.Variant = &variant
+	(*r.Features)[featureName] = s
+	return r
+}
+
+// SetConfigVersion sets the config version, unless it's empty.
+func (r *FeaturesResponse) SetConfigVersion(version string) *FeaturesResponse {
+	if version != "" {
+		r.ConfigVersion = &version
+	}
+	return r
+}
+
+func NewBatchResponse() *BatchResponse {
+	return &BatchResponse{
+		Results: &map[string]BatchResult{},
+	}
+}
+
+// SetConfigVersion sets the config version, unless it's empty.
+func (r *BatchResponse) SetConfigVersion(version string) *BatchResponse {
+	if version != "" {
+		r.ConfigVersion = &version
+	}
+	return r
+}
+
+func (r *BatchResponse) AddResult(key string, features *map[string]FeatureStatus) *BatchResponse {
+	(*r.Results)[key] = BatchResult{Features: features}
+	return r
+}
+
+func (r *BatchResponse) AddError(key, code, message string) *BatchResponse {
+	(*r.Results)[key] = BatchResult{Error: &Error{Code: code, Message: message}}
+	return r
+}
+
+func NewFeatureCatalog() *FeatureCatalog {
+	return &FeatureCatalog{
+		Features: &map[string]FeatureInfo{},
+	}
+}
+
+// SetConfigVersion sets the config version, unless it's empty.
+func (c *FeatureCatalog) SetConfigVersion(version string) *FeatureCatalog {
+	if version != "" {
+		c.ConfigVersion = &version
+	}
+	return c
+}
+
+// Reasons a feature is enabled or disabled, for Explanation.Reason.
+const (
+	ReasonTargetingMatch     = "TARGETING_MATCH"
+	ReasonSplit              = "SPLIT"
+	ReasonDisableMatch       = "DISABLE_MATCH"
+	ReasonDefault            = "DEFAULT"
+	ReasonOutOfSchedule      = "OUT_OF_SCHEDULE"
+	ReasonPrerequisiteFailed = "PREREQUISITE_FAILED"
+	ReasonError              = "ERROR"
+)
+
+func NewExplanation(reason string) *Explanation {
+	return &Explanation{
+		Reason: &reason,
+	}
+}
+
+// WithRule sets the rule that decided the status. id is omitted if it's
+// empty.
+func (e *Explanation) WithRule(index int, id string) *Explanation {
+	e.RuleIndex = &index
+	if id != "" {
+		e.RuleId = &id
+	}
+	return e
+}
+
+func (e *Explanation) WithWeight(bucket, weight int) *Explanation {
+	e.Bucket = &bucket
+	e.Weight = &weight
+	return e
+}
+
+func (e *Explanation) WithPrerequisite(featureName string) *Explanation {
+	e.Prerequisite = &featureName
+	return e
+}
+
+func (e *Explanation) WithError(err error) *Explanation {
+	msg := err.Error()
+	e.Error = &msg
+	return e
+}
+
+// SetExplanation sets the explanation for the feature, adding it to the
+// response as disabled if it isn't there already.
+func (r *FeaturesResponse) SetExplanation(featureName string, e *Explanation) *FeaturesResponse {
+	s, ok := (*r.Features)[featureName]
+	if !ok {
+		enabled := false
+		s.Enabled = &enabled
+	}
+	s.Explanation = e
+	(*r.Features)[featureName] = s
+	return r
+}
+
+// Codes for Error.Code.
+const (
+	ErrorCodeInvalidRequest = "INVALID_REQUEST"
+	ErrorCodeInvalidVars    = "INVALID_VARS"
+	ErrorCodeUnknownFeature = "UNKNOWN_FEATURE"
+	ErrorCodeInternal       = "INTERNAL"
+)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/dylannz/feature-service/cfg"
+)
+
+// runValidate loads the config in a directory and reports whether it's valid,
+// so config changes can be checked in CI before they're deployed. Without -env
+// the config is checked with every environment's overlays as well as without
+// any. With -print it writes the effective config for the environment instead.
+// With -no-resolve references to environment variables and files aren't
+// resolved, so a config can be checked without the secrets it refers to. -merge
+// sets the policy for features defined in more than one file, as CONFIG_MERGE.
+// It returns the process exit code.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	env := flags.String("env", "", "only check the config with this environment's overlay files applied, as CONFIG_ENV")
+	printConfig := flags.Bool("print", false, "print the merged config as YAML")
+	noResolve := flags.Bool("no-resolve", false, "don't resolve references to environment variables and files")
+	merge := flags.String("merge", cfg.MergeOptIn, "the policy for features defined in more than one file, 'error', 'opt-in' or 'append', as CONFIG_MERGE")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: feature-service validate [-env <env>] [-merge <policy>] [-print] [-no-resolve] <dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	dir := flags.Arg(0)
+	load := cfg.LoadDir
+	if *noResolve {
+		load = cfg.LoadDirUnresolved
+	}
+	if *printConfig {
+		config, err := load(dir, *env, *merge)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: invalid config: %s\n", dir, err)
+			return 1
+		}
+		if err := config.EncodeYAML(stdout); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	envs := []string{*env}
+	if *env == "" {
+		found, err := cfg.Environments(dir)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: invalid config: %s\n", dir, err)
+			return 1
+		}
+		envs = append(envs, found...)
+	}
+	code := 0
+	warned := map[string]bool{}
+	for _, e := range envs {
+		name := dir
+		if e != "" {
+			name = fmt.Sprintf("%s (%s)", dir, e)
+		}
+		config, err := load(dir, e, *merge)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: invalid config: %s\n", name, err)
+			code = 1
+			continue
+		}
+		for _, w := range config.Warnings {
+			// files used by every environment only need warning about once
+			if !warned[w.Error()] {
+				warned[w.Error()] = true
+				fmt.Fprintf(stderr, "%s: warning: %s\n", dir, w)
+			}
+		}
+		fmt.Fprintf(stdout, "%s: ok, %d features\n", name, len(config.Features))
+	}
+	return code
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/dylannz/feature-service/cfg"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("validate", func() {
+	var stdout, stderr bytes.Buffer
+
+	BeforeEach(func() {
+		stdout.Reset()
+		stderr.Reset()
+	})
+
+	It("reports valid configs with their number of features", func() {
+		Expect(runValidate([]string{"./config"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("./config: ok, 9 features\n"))
+		Expect(stderr.String()).To(BeEmpty())
+	})
+
+	It("checks the config with every environment's overlays", func() {
+		Expect(runValidate([]string{"./cfg/fixtures/overlays"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal(
+			"./cfg/fixtures/overlays: ok, 2 features\n" +
+				"./cfg/fixtures/overlays (dev): ok, 2 features\n" +
+				"./cfg/fixtures/overlays (prod): ok, 3 features\n",
+		))
+
+		stdout.Reset()
+		Expect(runValidate([]string{"-env", "prod", "./cfg/fixtures/overlays"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("./cfg/fixtures/overlays (prod): ok, 3 features\n"))
+	})
+
+	It("warns about environments without overlays", func() {
+		Expect(runValidate([]string{"-env", "prd", "./cfg/fixtures/overlays"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("./cfg/fixtures/overlays (prd): ok, 2 features\n"))
+		Expect(stderr.String()).To(Equal("./cfg/fixtures/overlays: warning: no overlay files set 'environment: prd', so none are applied\n"))
+	})
+
+	It("fails for invalid configs, giving the file and line", func() {
+		Expect(runValidate([]string{"./cfg/fixtures/invalid_weight"}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(BeEmpty())
+		Expect(stderr.String()).To(Equal(
+			"./cfg/fixtures/invalid_weight: invalid config: cfg/fixtures/invalid_weight/bad.yml:9:11: " +
+				"features.stripe_billing.rules.enable[0].weight: weight (150) outside range 0-100\n",
+		))
+	})
+
+	It("fails for invalid overlays", func() {
+		Expect(runValidate([]string{"./cfg/fixtures/overlay_secrets"}, &stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(Equal("./cfg/fixtures/overlay_secrets: ok, 1 features\n"))
+		Expect(stderr.String()).To(HavePrefix(
+			"./cfg/fixtures/overlay_secrets (prod): invalid config: cfg/fixtures/overlay_secrets/checkout.prod.yaml:13:13: ",
+		))
+	})
+
+	It("doesn't resolve references with -no-resolve", func() {
+		Expect(runValidate([]string{"-no-resolve", "./cfg/fixtures/overlay_secrets"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal(
+			"./cfg/fixtures/overlay_secrets: ok, 1 features\n" +
+				"./cfg/fixtures/overlay_secrets (prod): ok, 1 features\n",
+		))
+	})
+
+	It("prints the merged config with -print", func() {
+		Expect(runValidate([]string{"-env", "dev", "-print", "./cfg/fixtures/overlays"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(HavePrefix("version: \"2.0\"\nfeatures:\n  checkout_v2:\n"))
+		config, err := cfg.LoadYAML(&stdout)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Features["checkout_v2"].Rules.Enable).To(HaveLen(1))
+	})
+
+	It("prints conditions with -print", func() {
+		Expect(runValidate([]string{"-print", "./cfg/fixtures/conditions"}, &stdout, &stderr)).To(Equal(0))
+		config, err := cfg.LoadYAML(&stdout)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Features["checkout_v3"].Rules.Enable[0].Not).To(Equal(&cfg.Condition{
+			Field:  "internal",
+			Values: cfg.MatchValues{Eq: []string{"true"}},
+		}))
+	})
+
+	It("warns about expired features", func() {
+		Expect(runValidate([]string{"./cfg/fixtures/metadata"}, &stdout, &stderr)).To(Equal(0))
+		Expect(stdout.String()).To(Equal("./cfg/fixtures/metadata: ok, 2 features\n"))
+		Expect(stderr.String()).To(ContainSubstring(
+			"./cfg/fixtures/metadata: warning: cfg/fixtures/metadata/a.yml:18:5: features.search_v2.expires_at: " +
+				"feature 'search_v2' expired at 2021-07-01T00:00:00Z and should be removed from the config by its owner 'team-search'\n",
+		))
+	})
+
+	It("fails without a directory", func() {
+		Expect(runValidate(nil, &stdout, &stderr)).To(Equal(2))
+		Expect(stderr.String()).To(HavePrefix("usage: feature-service validate"))
+	})
+})